@@ -0,0 +1,270 @@
+// Package client sends metrics to stat-proxy over UDP in the RL protocol.
+//
+// A Client keeps one socket, queues lines without blocking the caller and sends them
+// batched, several lines separated by \n in one datagram.
+package client
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const SumTag = "P"
+const SetTag = "S"
+const MaxTag = "M"
+const MinTag = "I"
+const AvgTag = "A"
+const HllTag = "L"
+const HllDayTag = "D"
+const StrSumTag = "T"
+const StrSetTag = "E"
+const StrMinTag = "N"
+const StrMaxTag = "X"
+const StrAvgTag = "G"
+
+type Config struct {
+	// Address of the proxy UDP listener, host:port
+	Address string
+	// App is AppName/nodeId
+	App string
+	// Lines waiting to be sent, when the queue is full new ones are dropped
+	QueueSize int
+	// Queued lines are sent at least this often
+	FlushInterval time.Duration
+	// Datagrams are never bigger unless a single line is
+	MaxPacketSize int
+}
+
+type Client struct {
+	// first field keeps it 64-bit aligned for atomic on 32-bit platforms
+	dropped  uint64
+	app      string
+	conn     net.Conn
+	queue    chan string
+	flush    time.Duration
+	size     int
+	recorder *Recorder
+	done     chan bool
+	once     sync.Once
+	closeErr error
+}
+
+// CreateClient connects to address with default settings
+func CreateClient(address, app string) (*Client, error) {
+	return CreateClientConfig(Config{Address: address, App: app})
+}
+
+func CreateClientConfig(config Config) (*Client, error) {
+	if config.QueueSize <= 0 {
+		config.QueueSize = 10000
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 200 * time.Millisecond
+	}
+	if config.MaxPacketSize <= 0 {
+		config.MaxPacketSize = 1400
+	}
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	client := &Client{
+		app:   config.App,
+		conn:  conn,
+		queue: make(chan string, config.QueueSize),
+		flush: config.FlushInterval,
+		size:  config.MaxPacketSize,
+		done:  make(chan bool),
+	}
+	go client.run()
+	return client, nil
+}
+
+// CreateNop returns a client that drops everything, for code that has nowhere to send metrics
+func CreateNop() *Client {
+	return &Client{}
+}
+
+func (client *Client) Sum(name string, value int64) {
+	client.int(name, SumTag, value)
+}
+func (client *Client) Avg(name string, value int64) {
+	client.int(name, AvgTag, value)
+}
+func (client *Client) Max(name string, value int64) {
+	client.int(name, MaxTag, value)
+}
+func (client *Client) Min(name string, value int64) {
+	client.int(name, MinTag, value)
+}
+func (client *Client) Set(name string, value int64) {
+	client.int(name, SetTag, value)
+}
+
+// Float values are kept as is, they may be mixed with int values of the same metric
+func (client *Client) SumFloat(name string, value float64) {
+	client.float(name, SumTag, value)
+}
+func (client *Client) AvgFloat(name string, value float64) {
+	client.float(name, AvgTag, value)
+}
+func (client *Client) MaxFloat(name string, value float64) {
+	client.float(name, MaxTag, value)
+}
+func (client *Client) MinFloat(name string, value float64) {
+	client.float(name, MinTag, value)
+}
+func (client *Client) SetFloat(name string, value float64) {
+	client.float(name, SetTag, value)
+}
+
+func (client *Client) StrSum(name string, value int64, pattern string) {
+	client.strInt(name, StrSumTag, value, pattern)
+}
+func (client *Client) StrAvg(name string, value int64, pattern string) {
+	client.strInt(name, StrAvgTag, value, pattern)
+}
+func (client *Client) StrMax(name string, value int64, pattern string) {
+	client.strInt(name, StrMaxTag, value, pattern)
+}
+func (client *Client) StrMin(name string, value int64, pattern string) {
+	client.strInt(name, StrMinTag, value, pattern)
+}
+func (client *Client) StrSet(name string, value int64, pattern string) {
+	client.strInt(name, StrSetTag, value, pattern)
+}
+
+func (client *Client) StrSumFloat(name string, value float64, pattern string) {
+	client.strFloat(name, StrSumTag, value, pattern)
+}
+func (client *Client) StrAvgFloat(name string, value float64, pattern string) {
+	client.strFloat(name, StrAvgTag, value, pattern)
+}
+func (client *Client) StrMaxFloat(name string, value float64, pattern string) {
+	client.strFloat(name, StrMaxTag, value, pattern)
+}
+func (client *Client) StrMinFloat(name string, value float64, pattern string) {
+	client.strFloat(name, StrMinTag, value, pattern)
+}
+func (client *Client) StrSetFloat(name string, value float64, pattern string) {
+	client.strFloat(name, StrSetTag, value, pattern)
+}
+
+// Hll counts unique values per flush interval
+func (client *Client) Hll(name, value string) {
+	client.send(name, HllTag, "0", value)
+}
+
+// HllDay counts unique values per day
+func (client *Client) HllDay(name, value string) {
+	client.send(name, HllDayTag, "0", value)
+}
+
+// Dropped returns how many lines did not fit into the queue
+func (client *Client) Dropped() uint64 {
+	return atomic.LoadUint64(&client.dropped)
+}
+
+// Close sends what is queued and closes the socket, later calls return the same error
+func (client *Client) Close() error {
+	if client.queue == nil {
+		return nil
+	}
+	client.once.Do(func() {
+		close(client.queue)
+		<-client.done
+		client.closeErr = client.conn.Close()
+	})
+	return client.closeErr
+}
+
+func (client *Client) int(name, kind string, value int64) {
+	client.send(name, kind, strconv.FormatInt(value, 10), "")
+}
+
+func (client *Client) strInt(name, kind string, value int64, pattern string) {
+	client.send(name, kind, strconv.FormatInt(value, 10), pattern)
+}
+
+func (client *Client) float(name, kind string, value float64) {
+	client.send(name, kind, formatFloat(value), "")
+}
+
+func (client *Client) strFloat(name, kind string, value float64, pattern string) {
+	client.send(name, kind, formatFloat(value), pattern)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+var nameReplacer = strings.NewReplacer(":", "_", "\n", " ")
+var patternReplacer = strings.NewReplacer("\n", " ")
+
+func (client *Client) send(name, kind, value, pattern string) {
+	if client.recorder != nil {
+		client.recorder.record(nameReplacer.Replace(name), kind, value, patternReplacer.Replace(pattern))
+		return
+	}
+	if client.queue == nil {
+		return
+	}
+	line := "RL:" + client.app + ":" + nameReplacer.Replace(name) + ":" + kind + ":" + value
+	if pattern != "" || withPattern(kind) {
+		line += ":" + patternReplacer.Replace(pattern)
+	}
+	defer func() {
+		// send after Close
+		if recover() != nil {
+			atomic.AddUint64(&client.dropped, 1)
+		}
+	}()
+	select {
+	case client.queue <- line:
+	default:
+		atomic.AddUint64(&client.dropped, 1)
+	}
+}
+
+func withPattern(kind string) bool {
+	switch kind {
+	case HllTag, HllDayTag, StrSumTag, StrSetTag, StrMinTag, StrMaxTag, StrAvgTag:
+		return true
+	}
+	return false
+}
+
+func (client *Client) run() {
+	defer close(client.done)
+	timer := time.NewTicker(client.flush)
+	defer timer.Stop()
+	var packet []byte
+	write := func() {
+		if len(packet) > 0 {
+			_, _ = client.conn.Write(packet)
+			packet = packet[:0]
+		}
+	}
+	for {
+		select {
+		case line, ok := <-client.queue:
+			if !ok {
+				write()
+				return
+			}
+			if len(packet) > 0 && len(packet)+1+len(line) > client.size {
+				write()
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			packet = append(packet, line...)
+		case <-timer.C:
+			write()
+		}
+	}
+}
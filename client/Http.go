@@ -0,0 +1,86 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Middleware reports every request handled by next, grouped by the route it returns:
+// prefix_requests and prefix_latency_ms by route, prefix_status by "route 2xx".
+// Use a route pattern rather than the raw path, patterns above the proxy limit are evicted
+func (client *Client) Middleware(prefix string, route func(r *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		writer := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			name := route(r)
+			if name == "" {
+				name = "unknown"
+			}
+			client.StrSum(prefix+"_requests", 1, name)
+			client.StrSum(prefix+"_status", 1, name+" "+strconv.Itoa(writer.status/100)+"xx")
+			client.StrAvgFloat(prefix+"_latency_ms", float64(time.Since(started))/float64(time.Millisecond), name)
+		}()
+		next.ServeHTTP(writer, r)
+	})
+}
+
+// MuxRoute names requests by the pattern of mux they match, like "/api/" or "GET /users/{id}"
+func MuxRoute(mux *http.ServeMux) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		_, pattern := mux.Handler(r)
+		return pattern
+	}
+}
+
+// MethodRoute names requests by method and the first path segment, for handlers without a mux
+func MethodRoute(r *http.Request) string {
+	path := r.URL.Path
+	for i := 1; i < len(path); i++ {
+		if path[i] == '/' {
+			path = path[:i]
+			break
+		}
+	}
+	return r.Method + " " + path
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (writer *statusWriter) WriteHeader(status int) {
+	if !writer.wroteHeader {
+		writer.status = status
+		writer.wroteHeader = true
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *statusWriter) Write(data []byte) (int, error) {
+	writer.wroteHeader = true
+	return writer.ResponseWriter.Write(data)
+}
+
+func (writer *statusWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (writer *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := writer.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("response writer can not be hijacked")
+}
+
+func (writer *statusWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
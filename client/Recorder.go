@@ -0,0 +1,65 @@
+package client
+
+import (
+	"strconv"
+	"sync"
+)
+
+// Record is one metric call seen by a Recorder, float values are kept as given
+type Record struct {
+	Name    string
+	Kind    string
+	Value   float64
+	Pattern string
+}
+
+// Recorder keeps what a client was asked to send, for unit tests
+type Recorder struct {
+	mutex   sync.Mutex
+	records []Record
+}
+
+// CreateRecorder returns a client that records instead of sending, and its recorder
+func CreateRecorder() (*Client, *Recorder) {
+	recorder := &Recorder{}
+	return &Client{recorder: recorder}, recorder
+}
+
+func (recorder *Recorder) record(name, kind, value, pattern string) {
+	parsed, _ := strconv.ParseFloat(value, 64)
+	recorder.mutex.Lock()
+	recorder.records = append(recorder.records, Record{Name: name, Kind: kind, Value: parsed, Pattern: pattern})
+	recorder.mutex.Unlock()
+}
+
+func (recorder *Recorder) Records() []Record {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	return append([]Record(nil), recorder.records...)
+}
+
+// Find returns records of the metric, with a pattern only those of that pattern
+func (recorder *Recorder) Find(name string, pattern string) []Record {
+	var result []Record
+	for _, record := range recorder.Records() {
+		if record.Name == name && (pattern == "" || record.Pattern == pattern) {
+			result = append(result, record)
+		}
+	}
+	return result
+}
+
+// Total adds up values of the metric, handy for counters
+func (recorder *Recorder) Total(name string, pattern string) float64 {
+	total := 0.0
+	for _, record := range recorder.Find(name, pattern) {
+		total += record.Value
+	}
+	return total
+}
+
+func (recorder *Recorder) Reset() {
+	recorder.mutex.Lock()
+	recorder.records = nil
+	recorder.mutex.Unlock()
+}
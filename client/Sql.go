@@ -0,0 +1,245 @@
+package client
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"time"
+)
+
+// WrapDriver reports every query and exec made through drv: prefix_queries, prefix_query_ms
+// and prefix_errors by statement kind (select, insert, update, ...). Register the result
+// under a new name and open the database with it:
+//
+//	sql.Register("postgres-stat", stat.WrapDriver(&pq.Driver{}, "db"))
+func (client *Client) WrapDriver(drv driver.Driver, prefix string) driver.Driver {
+	return &statDriver{driver: drv, client: client, prefix: prefix}
+}
+
+type statDriver struct {
+	driver driver.Driver
+	client *Client
+	prefix string
+}
+
+func (d *statDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &statConn{conn: conn, driver: d}, nil
+}
+
+func (d *statDriver) OpenConnector(name string) (driver.Connector, error) {
+	if withConnector, ok := d.driver.(driver.DriverContext); ok {
+		connector, err := withConnector.OpenConnector(name)
+		if err != nil {
+			return nil, err
+		}
+		return &statConnector{connector: connector, driver: d}, nil
+	}
+	return &statConnector{name: name, driver: d}, nil
+}
+
+func (d *statDriver) report(query string, started time.Time, err error) {
+	if errors.Is(err, driver.ErrSkip) {
+		return
+	}
+	kind := statementKind(query)
+	d.client.StrSum(d.prefix+"_queries", 1, kind)
+	d.client.StrAvgFloat(d.prefix+"_query_ms", float64(time.Since(started))/float64(time.Millisecond), kind)
+	if err != nil {
+		d.client.StrSum(d.prefix+"_errors", 1, kind)
+	}
+}
+
+// First keyword of the statement, it keeps the number of patterns small
+func statementKind(query string) string {
+	fields := strings.Fields(strings.TrimLeft(query, "( \t\r\n"))
+	if len(fields) == 0 {
+		return "empty"
+	}
+	kind := strings.ToLower(fields[0])
+	if len(kind) > 20 {
+		kind = kind[:20]
+	}
+	return kind
+}
+
+type statConnector struct {
+	connector driver.Connector
+	name      string
+	driver    *statDriver
+}
+
+func (c *statConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var conn driver.Conn
+	var err error
+	if c.connector != nil {
+		conn, err = c.connector.Connect(ctx)
+	} else {
+		conn, err = c.driver.driver.Open(c.name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &statConn{conn: conn, driver: c.driver}, nil
+}
+
+func (c *statConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// statConn passes optional interfaces through, when the wrapped connection lacks one
+// driver.ErrSkip makes database/sql fall back to the next way of running the query
+type statConn struct {
+	conn   driver.Conn
+	driver *statDriver
+}
+
+func (c *statConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &statStmt{stmt: stmt, query: query, driver: c.driver}, nil
+}
+
+func (c *statConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.conn.(driver.ConnPrepareContext); ok {
+		stmt, err := preparer.PrepareContext(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		return &statStmt{stmt: stmt, query: query, driver: c.driver}, nil
+	}
+	return c.Prepare(query)
+}
+
+func (c *statConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *statConn) Begin() (driver.Tx, error) {
+	return c.conn.Begin()
+}
+
+func (c *statConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.conn.Begin()
+}
+
+func (c *statConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	started := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	c.driver.report(query, started, err)
+	return rows, err
+}
+
+func (c *statConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	started := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	c.driver.report(query, started, err)
+	return result, err
+}
+
+func (c *statConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *statConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *statConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+type statStmt struct {
+	stmt   driver.Stmt
+	query  string
+	driver *statDriver
+}
+
+func (s *statStmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s *statStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+func (s *statStmt) Exec(args []driver.Value) (driver.Result, error) {
+	started := time.Now()
+	result, err := s.stmt.Exec(args)
+	s.driver.report(s.query, started, err)
+	return result, err
+}
+
+func (s *statStmt) Query(args []driver.Value) (driver.Rows, error) {
+	started := time.Now()
+	rows, err := s.stmt.Query(args)
+	s.driver.report(s.query, started, err)
+	return rows, err
+}
+
+func (s *statStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := s.stmt.(driver.StmtExecContext)
+	if !ok {
+		values, err := namedToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.Exec(values)
+	}
+	started := time.Now()
+	result, err := execer.ExecContext(ctx, args)
+	s.driver.report(s.query, started, err)
+	return result, err
+}
+
+func (s *statStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := s.stmt.(driver.StmtQueryContext)
+	if !ok {
+		values, err := namedToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.Query(values)
+	}
+	started := time.Now()
+	rows, err := queryer.QueryContext(ctx, args)
+	s.driver.report(s.query, started, err)
+	return rows, err
+}
+
+func namedToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("driver does not support named parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
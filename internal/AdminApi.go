@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Read only views of what CoreStatistic holds, nothing here drains or creates apps
+
+type adminMetric struct {
+	Kind  string  `json:"kind"`
+	Value float64 `json:"value"`
+}
+
+type adminPatterns struct {
+	Kind     string             `json:"kind"`
+	Size     int                `json:"size"`
+	Capacity int                `json:"capacity"`
+	Values   map[string]float64 `json:"values"`
+}
+
+type adminAppSummary struct {
+	App         string `json:"app"`
+	Overload    bool   `json:"overload"`
+	Metrics     int    `json:"metrics"`
+	DayMetrics  int    `json:"day_metrics"`
+	Strings     int    `json:"strings"`
+	Patterns    int    `json:"patterns"`
+	MemoryBytes int    `json:"memory_bytes"`
+}
+
+type adminApp struct {
+	adminAppSummary
+	MetricValues map[string]adminMetric   `json:"metric_values"`
+	DayValues    map[string]adminMetric   `json:"day_values"`
+	StringValues map[string]adminPatterns `json:"string_values"`
+}
+
+func adminSummary(appName string, app *AppStatistic, snapshot AppSnapshot) adminAppSummary {
+	summary := adminAppSummary{
+		App:         appName,
+		Overload:    snapshot.Overload,
+		Metrics:     len(snapshot.Metrics),
+		DayMetrics:  len(snapshot.Day),
+		Strings:     len(snapshot.Strings),
+		MemoryBytes: app.MemoryEstimate(),
+	}
+	for _, patterns := range snapshot.Strings {
+		summary.Patterns += len(patterns.Values)
+	}
+	return summary
+}
+
+func adminMetrics(metrics map[string]MetricValue) map[string]adminMetric {
+	result := make(map[string]adminMetric, len(metrics))
+	for name, value := range metrics {
+		result[name] = adminMetric{Kind: value.Kind, Value: value.Value}
+	}
+	return result
+}
+
+// GET /api/apps
+func (server *AdminServer) apiApps(w http.ResponseWriter, r *http.Request) {
+	apps := server.core.Apps()
+	result := make([]adminAppSummary, 0, len(apps))
+	for appName, app := range apps {
+		result = append(result, adminSummary(appName, app, app.Snapshot()))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].App < result[j].App
+	})
+	writeJson(w, http.StatusOK, result)
+}
+
+// GET /api/apps/AppName/nodeId
+func (server *AdminServer) apiApp(w http.ResponseWriter, r *http.Request) {
+	server.writeApp(w, strings.TrimPrefix(r.URL.Path, "/api/apps/"))
+}
+
+// GET /api/self, metrics the proxy collects about itself since the last flush
+func (server *AdminServer) apiSelf(w http.ResponseWriter, r *http.Request) {
+	if server.self == nil {
+		writeJsonError(w, http.StatusNotFound, "self monitoring is off")
+		return
+	}
+	server.writeApp(w, server.self.App())
+}
+
+func (server *AdminServer) writeApp(w http.ResponseWriter, appName string) {
+	app, has := server.core.Apps()[appName]
+	if !has {
+		writeJsonError(w, http.StatusNotFound, "no app "+appName)
+		return
+	}
+	snapshot := app.Snapshot()
+	result := adminApp{
+		adminAppSummary: adminSummary(appName, app, snapshot),
+		MetricValues:    adminMetrics(snapshot.Metrics),
+		DayValues:       adminMetrics(snapshot.Day),
+		StringValues:    make(map[string]adminPatterns, len(snapshot.Strings)),
+	}
+	for name, patterns := range snapshot.Strings {
+		result.StringValues[name] = adminPatterns{
+			Kind:     patterns.Kind,
+			Size:     len(patterns.Values),
+			Capacity: PatternSize,
+			Values:   patterns.Values,
+		}
+	}
+	writeJson(w, http.StatusOK, result)
+}
+
+// GET /api/runtime
+func (server *AdminServer) apiRuntime(w http.ResponseWriter, r *http.Request) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"goroutines":  runtime.NumGoroutine(),
+		"heap_alloc":  stats.HeapAlloc,
+		"heap_sys":    stats.HeapSys,
+		"sys":         stats.Sys,
+		"num_gc":      stats.NumGC,
+		"apps":        len(server.core.Apps()),
+		"max_metrics": server.core.MaxMetrics(),
+	})
+}
+
+// GET /api/tail[?app=&metric=&type=][&format=ndjson] streams records as they are applied,
+// as Server-Sent Events by default. A slow reader loses events instead of slowing ingestion,
+// the number lost so far is sent as a dropped event
+func (server *AdminServer) apiTail(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJsonError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	params := r.URL.Query()
+	ndjson := params.Get("format") == "ndjson" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+	subscriber := server.core.Tail().Subscribe(TailFilter{
+		App:    params.Get("app"),
+		Metric: params.Get("metric"),
+		Type:   params.Get("type"),
+	})
+	defer server.core.Tail().Unsubscribe(subscriber)
+
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	var dropped uint64
+	for {
+		var err error
+		select {
+		case event := <-subscriber.Events:
+			if ndjson {
+				err = encoder.Encode(event)
+			} else {
+				_, err = w.Write([]byte("data: "))
+				if err == nil {
+					err = encoder.Encode(event)
+				}
+				if err == nil {
+					_, err = w.Write([]byte("\n"))
+				}
+			}
+		case <-keepAlive.C:
+			if !ndjson {
+				_, err = w.Write([]byte(": keep-alive\n\n"))
+			}
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		if now := subscriber.Dropped(); now != dropped {
+			dropped = now
+			if ndjson {
+				err = encoder.Encode(map[string]uint64{"dropped": dropped})
+			} else {
+				_, err = fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", dropped)
+			}
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"net/http"
+	"sync"
+)
+
+// AdminServer exposes what the proxy holds in memory, it never drains CoreStatistic
+type AdminServer struct {
+	host   string
+	core   *CoreStatistic
+	server *http.Server
+	stop   bool
+	mutex  sync.Mutex
+	logger *Logger
+	health *ServicePoll
+	self   *SelfStat
+}
+
+func CreateAdminServer(host string, core *CoreStatistic, logger *Logger) *AdminServer {
+	return &AdminServer{
+		host:   host,
+		core:   core,
+		logger: logger.Named("AdminServer"),
+	}
+}
+
+func (server *AdminServer) SetSelfStat(self *SelfStat) {
+	server.self = self
+}
+
+// SetHealth serves /healthz and /readyz for the services of poll
+func (server *AdminServer) SetHealth(poll *ServicePoll) {
+	server.health = poll
+}
+
+func (server *AdminServer) Start() error {
+	var mux http.ServeMux
+	mux.HandleFunc("/metrics", server.metrics)
+	mux.HandleFunc("/api/apps", server.apiApps)
+	mux.HandleFunc("/api/apps/", server.apiApp)
+	mux.HandleFunc("/api/runtime", server.apiRuntime)
+	mux.HandleFunc("/api/tail", server.apiTail)
+	mux.HandleFunc("/api/self", server.apiSelf)
+	if server.health != nil {
+		mux.HandleFunc("/healthz", server.health.Healthz)
+		mux.HandleFunc("/readyz", server.health.Readyz)
+	}
+	httpServer := &http.Server{Addr: server.host, Handler: &mux}
+	server.mutex.Lock()
+	server.server = httpServer
+	stop := server.stop
+	server.mutex.Unlock()
+	if stop {
+		return nil
+	}
+	server.logger.Info("listening", "address", server.host)
+	err := httpServer.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// ResetStop is called by ServicePoll before every Start
+func (server *AdminServer) ResetStop() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.stop = false
+}
+
+func (server *AdminServer) Reload(config *Config) bool {
+	if config.AdminHttp == "" || config.AdminHttp == server.host {
+		return false
+	}
+	server.host = config.AdminHttp
+	return true
+}
+
+func (server *AdminServer) GetName() string {
+	return "AdminServer"
+}
+
+func (server *AdminServer) Stop() error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.stop = true
+	if server.server != nil {
+		return server.server.Close()
+	}
+	return nil
+}
+
+func (server *AdminServer) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	err := WritePrometheus(w, server.core.Snapshot())
+	if err != nil {
+		server.logger.Error("write metrics failed", "error", err)
+	}
+}
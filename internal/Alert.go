@@ -0,0 +1,330 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/pgxpool"
+	"os"
+	"strings"
+	"time"
+)
+
+const alertInactive = "inactive"
+const alertPending = "pending"
+
+// AlertRule fires when Agg of Metric over all nodes of App compares to Threshold by Op in For
+// intervals in a row. Agg folds every value stored for the app during the interval. With Pattern
+// the string metric value of that pattern is taken, Tags limit series to those having all of them
+type AlertRule struct {
+	Name      string            `json:"name"`
+	App       string            `json:"app"`
+	Metric    string            `json:"metric"`
+	Pattern   string            `json:"pattern,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Agg       string            `json:"agg,omitempty"`
+	Op        string            `json:"op"`
+	Threshold float64           `json:"threshold"`
+	For       int               `json:"for,omitempty"`
+}
+
+var alertOps = map[string]func(value, threshold float64) bool{
+	">":  func(value, threshold float64) bool { return value > threshold },
+	">=": func(value, threshold float64) bool { return value >= threshold },
+	"<":  func(value, threshold float64) bool { return value < threshold },
+	"<=": func(value, threshold float64) bool { return value <= threshold },
+	"==": func(value, threshold float64) bool { return value == threshold },
+	"!=": func(value, threshold float64) bool { return value != threshold },
+}
+
+// LoadAlertRules reads a JSON array of rules
+func LoadAlertRules(fileName string) ([]AlertRule, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var rules []AlertRule
+	err = json.NewDecoder(file).Decode(&rules)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Name == "" || rule.App == "" || rule.Metric == "" {
+			return nil, fmt.Errorf("rule %d: name, app and metric are required", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rule %s: duplicate name", rule.Name)
+		}
+		names[rule.Name] = true
+		if _, has := alertOps[rule.Op]; !has {
+			return nil, fmt.Errorf("rule %s: op must be one of > >= < <= == !=", rule.Name)
+		}
+		if rule.Agg == "" {
+			rule.Agg = "sum"
+		}
+		if rule.Agg != "sum" && rule.Agg != "avg" && rule.Agg != "min" && rule.Agg != "max" {
+			return nil, fmt.Errorf("rule %s: agg must be one of sum, avg, min, max", rule.Name)
+		}
+		if rule.For < 1 {
+			rule.For = 1
+		}
+	}
+	return rules, nil
+}
+
+func (rule AlertRule) matches(key string) bool {
+	name, tags := splitTaggedName(key)
+	if name != rule.Metric {
+		return false
+	}
+	for tag, value := range rule.Tags {
+		if tags[tag] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns false when no batch of the window has nodes of the app. A sum of a metric nobody
+// wrote is zero, other aggregates have nothing to compare then
+func (rule AlertRule) evaluate(window []alertBatch) (float64, bool) {
+	var values []float64
+	seen := false
+	for _, batch := range window {
+		// string rules only look at string batches and the other way round
+		if (rule.Pattern != "") != (batch.strs != nil) {
+			continue
+		}
+		for appName, metrics := range batch.ints {
+			if strings.SplitN(appName, "/", 2)[0] != rule.App {
+				continue
+			}
+			seen = true
+			for key, metric := range metrics {
+				if rule.matches(key) {
+					values = append(values, metric.Value)
+				}
+			}
+		}
+		for appName, metrics := range batch.strs {
+			if strings.SplitN(appName, "/", 2)[0] != rule.App {
+				continue
+			}
+			seen = true
+			for key, metric := range metrics {
+				if value, has := metric.Values[rule.Pattern]; has && rule.matches(key) {
+					values = append(values, value)
+				}
+			}
+		}
+	}
+	if !seen || (len(values) == 0 && rule.Agg != "sum") {
+		return 0, false
+	}
+	result := 0.0
+	for i, value := range values {
+		switch {
+		case rule.Agg == "sum" || rule.Agg == "avg":
+			result += value
+		case i == 0:
+			result = value
+		case rule.Agg == "min" && value < result:
+			result = value
+		case rule.Agg == "max" && value > result:
+			result = value
+		}
+	}
+	if rule.Agg == "avg" {
+		result /= float64(len(values))
+	}
+	return result, true
+}
+
+type alertState struct {
+	State string
+	Hits  int
+	Value float64
+	Since time.Time
+}
+
+type alertBatch struct {
+	ints map[string]map[string]MetricValue
+	strs map[string]map[string]PatternValues
+}
+
+// AlertService collects the batches StatSaver stores and evaluates rules over them once an
+// interval, states survive restarts in alert_states
+type AlertService struct {
+	logger      *Logger
+	databaseUrl string
+	connection  *pgxpool.Pool
+	rules       []AlertRule
+	states      map[string]*alertState
+	notifier    *Notifier
+	interval    time.Duration
+	batches     chan alertBatch
+	stop        chan bool
+}
+
+func CreateAlertService(logger *Logger, url string, rules []AlertRule, notifier *Notifier, interval time.Duration) *AlertService {
+	return &AlertService{
+		logger:      logger.Named("Alerts"),
+		databaseUrl: url,
+		rules:       rules,
+		states:      make(map[string]*alertState),
+		notifier:    notifier,
+		interval:    interval,
+		batches:     make(chan alertBatch, 100),
+		stop:        make(chan bool, 1),
+	}
+}
+
+func (service *AlertService) Start() error {
+	if service.connection == nil {
+		conn, err := ConnectPostgres(service.databaseUrl)
+		if err != nil {
+			return err
+		}
+		service.connection = conn
+	}
+	err := service.loadStates()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(service.interval)
+	defer ticker.Stop()
+	var window []alertBatch
+	for {
+		select {
+		case batch := <-service.batches:
+			window = append(window, batch)
+		case now := <-ticker.C:
+			service.evaluate(window, now.UTC())
+			window = nil
+		case <-service.stop:
+			service.connection.Close()
+			service.connection = nil
+			return nil
+		}
+	}
+}
+
+func (service *AlertService) Stop() error {
+	service.stop <- true
+	return nil
+}
+
+func (service *AlertService) GetName() string {
+	return "Alerts"
+}
+
+func (service *AlertService) SavedInt(data map[string]map[string]MetricValue, at time.Time) {
+	service.push(alertBatch{ints: data})
+}
+
+func (service *AlertService) SavedString(data map[string]map[string]PatternValues, at time.Time) {
+	service.push(alertBatch{strs: data})
+}
+
+func (service *AlertService) push(batch alertBatch) {
+	select {
+	case service.batches <- batch:
+	default:
+		service.logger.Warn("queue is full, batch skipped")
+	}
+}
+
+func (service *AlertService) loadStates() error {
+	_, err := service.connection.Exec(context.Background(), `create table IF NOT EXISTS alert_states
+(
+	rule varchar(100) primary key,
+	state varchar(10) not null,
+	hits integer not null,
+	value double precision not null,
+	since timestamp not null,
+	updated_at timestamp default now()
+);
+`)
+	if err != nil {
+		return err
+	}
+	rows, err := service.connection.Query(context.Background(), "select rule, state, hits, value, since from alert_states")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		state := &alertState{}
+		err = rows.Scan(&name, &state.State, &state.Hits, &state.Value, &state.Since)
+		if err != nil {
+			return err
+		}
+		service.states[name] = state
+	}
+	return rows.Err()
+}
+
+func (service *AlertService) evaluate(window []alertBatch, now time.Time) {
+	for _, rule := range service.rules {
+		value, ok := rule.evaluate(window)
+		if !ok {
+			continue
+		}
+		state, has := service.states[rule.Name]
+		if !has {
+			state = &alertState{State: alertInactive, Since: now}
+			service.states[rule.Name] = state
+		}
+		previous := state.State
+		state.Value = value
+		if alertOps[rule.Op](value, rule.Threshold) {
+			state.Hits++
+			if state.State != AlertFiring {
+				if state.State != alertPending {
+					state.Since = now
+				}
+				state.State = alertPending
+				if state.Hits >= rule.For {
+					state.State = AlertFiring
+				}
+			}
+		} else {
+			state.Hits = 0
+			if state.State == AlertFiring {
+				state.State = AlertResolved
+				state.Since = now
+			} else if state.State == alertPending {
+				state.State = alertInactive
+				state.Since = now
+			}
+		}
+		err := service.saveState(rule.Name, state)
+		if err != nil {
+			service.logger.Error("state save failed", "rule", rule.Name, "error", err)
+		}
+		if state.State != previous && (state.State == AlertFiring || state.State == AlertResolved) {
+			service.notifier.Notify(Alert{
+				Rule:      rule.Name,
+				State:     state.State,
+				App:       rule.App,
+				Metric:    rule.Metric,
+				Value:     value,
+				Threshold: rule.Threshold,
+				Message:   fmt.Sprintf("%s %s %s %s %g (value %g)", rule.App, rule.Metric, rule.Agg, rule.Op, rule.Threshold, value),
+				At:        now,
+			})
+		}
+	}
+}
+
+func (service *AlertService) saveState(name string, state *alertState) error {
+	_, err := service.connection.Exec(context.Background(), `INSERT INTO alert_states(rule,state,hits,value,since) VALUES ($1,$2,$3,$4,$5)
+ON CONFLICT (rule) DO UPDATE
+SET state = excluded.state, hits = excluded.hits, value = excluded.value, since = excluded.since, updated_at = now()`,
+		name, state.State, state.Hits, state.Value, state.Since)
+	return err
+}
@@ -0,0 +1,277 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Number of previous intervals the rolling median is taken over
+const AnomalyWindow = 12
+
+type AnomalyTarget struct {
+	App     string
+	Metric  string
+	Pattern string
+}
+
+// ParseAnomalyTargets reads app:metric[:pattern] targets separated by ;
+func ParseAnomalyTargets(value string) ([]AnomalyTarget, error) {
+	var targets []AnomalyTarget
+	for _, raw := range strings.Split(value, ";") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		parts := strings.SplitN(raw, ":", 3)
+		if len(parts) < 2 || !queryAppName.MatchString(parts[0]) || parts[1] == "" {
+			return nil, fmt.Errorf("bad anomaly target %s, expected app:metric[:pattern]", raw)
+		}
+		target := AnomalyTarget{App: parts[0], Metric: parts[1]}
+		if len(parts) == 3 {
+			target.Pattern = parts[2]
+		}
+		targets = append(targets, target)
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("no anomaly targets")
+	}
+	return targets, nil
+}
+
+func (target AnomalyTarget) String() string {
+	if target.Pattern == "" {
+		return target.App + ":" + target.Metric
+	}
+	return target.App + ":" + target.Metric + ":" + target.Pattern
+}
+
+type anomalyScore struct {
+	value   float64
+	weekAgo *float64
+	median  float64
+	score   float64
+}
+
+// Robust z-score of value against a baseline, spread comes from the median absolute deviation
+// of the window and never goes below 1% of the median so flat series do not score on noise
+func robustScore(value, baseline float64, window []float64) float64 {
+	median := medianOf(window)
+	deviations := make([]float64, len(window))
+	for i, v := range window {
+		deviations[i] = math.Abs(v - median)
+	}
+	spread := 1.4826 * medianOf(deviations)
+	spread = math.Max(spread, math.Abs(median)*0.01)
+	spread = math.Max(spread, 1e-9)
+	return (value - baseline) / spread
+}
+
+func medianOf(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// AnomalyService compares the last complete interval of every target with the same interval a week
+// ago and with the median of previous intervals. When both baselines exist the score closer to zero
+// is taken, so a change has to stand out from both of them
+type AnomalyService struct {
+	logger     *Logger
+	saver      *StatSaver
+	notifier   *Notifier
+	targets    []AnomalyTarget
+	interval   time.Duration
+	deviation  float64
+	firing     map[string]bool
+	tableReady bool
+	stop       chan bool
+}
+
+func CreateAnomalyService(logger *Logger, saver *StatSaver, notifier *Notifier, targets []AnomalyTarget, interval time.Duration, deviation float64) *AnomalyService {
+	return &AnomalyService{
+		logger:    logger.Named("Anomaly"),
+		saver:     saver,
+		notifier:  notifier,
+		targets:   targets,
+		interval:  interval,
+		deviation: deviation,
+		firing:    make(map[string]bool),
+		stop:      make(chan bool, 1),
+	}
+}
+
+func (service *AnomalyService) Start() error {
+	timer := time.NewTicker(service.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			service.checkAll(intervalEnd(time.Now(), service.interval))
+		case <-service.stop:
+			return nil
+		}
+	}
+}
+
+func (service *AnomalyService) Stop() error {
+	service.stop <- true
+	return nil
+}
+
+func (service *AnomalyService) GetName() string {
+	return "Anomaly"
+}
+
+// Intervals are aligned to the unix epoch like the buckets of Series, so the last one is a
+// single bucket whatever ANOMALY_INTERVAL is
+func intervalEnd(now time.Time, interval time.Duration) time.Time {
+	step := int64(interval / time.Second)
+	return time.Unix(now.Unix()-now.Unix()%step, 0).UTC()
+}
+
+func (service *AnomalyService) checkAll(end time.Time) {
+	// saver connects in its own Start
+	if err := service.saver.CheckHealth(); err != nil {
+		service.logger.Warn("check skipped", "error", err)
+		return
+	}
+	if !service.tableReady {
+		err := service.saver.createAnomalyTable()
+		if err != nil {
+			service.logger.Error("table not created", "error", err)
+			return
+		}
+		service.tableReady = true
+	}
+	for _, target := range service.targets {
+		score, ok, err := service.score(target, end)
+		if err != nil {
+			service.logger.Error("check failed", "target", target.String(), "error", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		err = service.saver.saveAnomalyScore(target, end.Add(-service.interval), score)
+		if err != nil {
+			service.logger.Error("score save failed", "target", target.String(), "error", err)
+		}
+		service.notify(target, score, end)
+	}
+}
+
+func (service *AnomalyService) series(target AnomalyTarget, from, to time.Time) ([][2]float64, error) {
+	series, err := service.saver.Series(SeriesQuery{
+		App:     target.App,
+		Metric:  target.Metric,
+		Pattern: target.Pattern,
+		From:    from,
+		To:      to,
+		Step:    int(service.interval.Seconds()),
+		Source:  "raw",
+	})
+	if err != nil || len(series) == 0 {
+		return nil, err
+	}
+	return series[0].Points, nil
+}
+
+// Returns false when the last interval or its history has no data
+func (service *AnomalyService) score(target AnomalyTarget, end time.Time) (anomalyScore, bool, error) {
+	result := anomalyScore{}
+	start := end.Add(-service.interval)
+	current, err := service.series(target, start, end)
+	if err != nil || len(current) == 0 {
+		return result, false, err
+	}
+	result.value = current[len(current)-1][1]
+
+	history, err := service.series(target, start.Add(-AnomalyWindow*service.interval), start)
+	if err != nil || len(history) < AnomalyWindow/2 {
+		return result, false, err
+	}
+	window := make([]float64, len(history))
+	for i, point := range history {
+		window[i] = point[1]
+	}
+	result.median = medianOf(window)
+	result.score = robustScore(result.value, result.median, window)
+
+	weekStart := start.Add(-7 * 24 * time.Hour)
+	weekAgo, err := service.series(target, weekStart, weekStart.Add(service.interval))
+	if err != nil {
+		return result, false, err
+	}
+	if len(weekAgo) > 0 {
+		value := weekAgo[len(weekAgo)-1][1]
+		result.weekAgo = &value
+		weekScore := robustScore(result.value, value, window)
+		if math.Abs(weekScore) < math.Abs(result.score) {
+			result.score = weekScore
+		}
+	}
+	return result, true, nil
+}
+
+func (service *AnomalyService) notify(target AnomalyTarget, score anomalyScore, at time.Time) {
+	name := target.String()
+	anomalous := math.Abs(score.score) > service.deviation
+	if anomalous == service.firing[name] {
+		return
+	}
+	service.firing[name] = anomalous
+	alert := Alert{
+		Rule:      "anomaly " + name,
+		State:     AlertResolved,
+		App:       target.App,
+		Metric:    target.Metric,
+		Value:     score.value,
+		Threshold: service.deviation,
+		Message:   fmt.Sprintf("%s is back to normal, value %g median %g", name, score.value, score.median),
+		At:        at,
+	}
+	if anomalous {
+		alert.State = AlertFiring
+		alert.Message = fmt.Sprintf("%s deviates by %.1f, value %g median %g", name, score.score, score.value, score.median)
+		if score.weekAgo != nil {
+			alert.Message += fmt.Sprintf(" week ago %g", *score.weekAgo)
+		}
+	}
+	service.notifier.Notify(alert)
+}
+
+func (saver *StatSaver) createAnomalyTable() error {
+	_, err := saver.connection.Exec(context.Background(), `create table IF NOT EXISTS anomaly_scores
+(
+	created_at timestamp not null,
+	app varchar(100) not null,
+	metric varchar(50) not null,
+	pattern varchar(200) not null default '',
+	value double precision not null,
+	week_ago double precision,
+	median double precision not null,
+	score double precision not null
+);
+create index IF NOT EXISTS anomaly_scores_created_at_index on anomaly_scores (created_at desc);
+`)
+	return err
+}
+
+func (saver *StatSaver) saveAnomalyScore(target AnomalyTarget, at time.Time, score anomalyScore) error {
+	_, err := saver.connection.Exec(context.Background(),
+		"INSERT INTO anomaly_scores(created_at,app,metric,pattern,value,week_ago,median,score) VALUES ($1,$2,$3,$4,$5,$6,$7,$8)",
+		at, target.App, target.Metric, target.Pattern, score.value, score.weekAgo, score.median, score.score)
+	return err
+}
@@ -1,63 +1,143 @@
 package internal
 
 import (
+	"fmt"
 	"github.com/axiomhq/hyperloglog"
 	lru "github.com/hashicorp/golang-lru"
-	"log"
+	"strings"
 	"sync"
 )
 
 const MaxMetricCount = 70
 const PatternSize = 100
 
+// MetricValue is an aggregated metric together with the tag of operation that produced it
+type MetricValue struct {
+	Kind  string  `json:"k"`
+	Value float64 `json:"v"`
+}
+
+// PatternValues holds all patterns of one string metric, they share the same kind
+type PatternValues struct {
+	Kind   string             `json:"k"`
+	Values map[string]float64 `json:"v"`
+}
+
 type AppStatistic struct {
-	metrics  map[string]int
-	patterns map[string]*lru.Cache
-	hll      map[string]*hyperloglog.Sketch
-	hllDay   map[string]*hyperloglog.Sketch
-	name     string
-	overload bool
-	mutex    sync.Mutex
+	metrics      map[string]float64
+	kinds        map[string]string
+	patterns     map[string]*lru.Cache
+	patternKinds map[string]string
+	hll          map[string]*hyperloglog.Sketch
+	hllDay       map[string]*hyperloglog.Sketch
+	tagged       map[string]*AppStatistic
+	tagSets      map[string]map[string]bool
+	tagSetCount  int
+	name         string
+	logger       *Logger
+	maxMetrics   int
+	overload     bool
+	mutex        sync.Mutex
 }
 
-func CreateAppStatistic(name string) *AppStatistic {
+func CreateAppStatistic(name string, logger *Logger) *AppStatistic {
 	return &AppStatistic{
-		name:     name,
-		metrics:  make(map[string]int),
-		patterns: make(map[string]*lru.Cache),
-		hll:      make(map[string]*hyperloglog.Sketch),
-		hllDay:   make(map[string]*hyperloglog.Sketch),
-		overload: false,
-		mutex:    sync.Mutex{},
+		name:         name,
+		logger:       logger,
+		maxMetrics:   MaxMetricCount,
+		metrics:      make(map[string]float64),
+		kinds:        make(map[string]string),
+		patterns:     make(map[string]*lru.Cache),
+		patternKinds: make(map[string]string),
+		hll:          make(map[string]*hyperloglog.Sketch),
+		hllDay:       make(map[string]*hyperloglog.Sketch),
+		tagged:       make(map[string]*AppStatistic),
+		tagSets:      make(map[string]map[string]bool),
+		overload:     false,
+		mutex:        sync.Mutex{},
 	}
 }
 
 func (app *AppStatistic) overloadCheck() {
-	if len(app.metrics) > MaxMetricCount {
+	if len(app.metrics) > app.maxMetrics {
+		app.overload = true
+	}
+	if len(app.patterns) > app.maxMetrics {
 		app.overload = true
 	}
-	if len(app.patterns) > MaxMetricCount {
+	if len(app.hll) > app.maxMetrics {
 		app.overload = true
 	}
-	if len(app.hll) > MaxMetricCount {
+	if len(app.hllDay) > app.maxMetrics {
 		app.overload = true
 	}
-	if len(app.hllDay) > MaxMetricCount {
+	if len(app.tagSets) > app.maxMetrics || app.tagSetCount > app.maxMetrics {
 		app.overload = true
 	}
 }
 
-func (app *AppStatistic) Sum(name string, value int) {
+// IsOverloaded tells whether the app drops new metrics until the next flush
+func (app *AppStatistic) IsOverloaded() bool {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	return app.overload
+}
+
+// SetMaxMetrics changes the limit of the app and its tag sets, it is checked on the next write
+func (app *AppStatistic) SetMaxMetrics(limit int) {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	app.maxMetrics = limit
+	for _, tagged := range app.tagged {
+		tagged.SetMaxMetrics(limit)
+	}
+}
+
+// Tagged returns the statistic that aggregates metric name for one tag set. Each tag set is a
+// separate AppStatistic with its own limits, a metric gets at most MaxTagSets of them between
+// two flushes. Like metrics tag sets count against the limit of the app, an overloaded app
+// takes no new ones
+func (app *AppStatistic) Tagged(name string, tags map[string]string) (*AppStatistic, error) {
+	key := tagSetKey(tags)
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	sets := app.tagSets[name]
+	if !sets[key] {
+		if app.overload {
+			return nil, fmt.Errorf("App overloaded, no new tag sets for metric %s", name)
+		}
+		if len(sets) >= MaxTagSets {
+			return nil, fmt.Errorf("Too many tag sets for metric %s, max %d", name, MaxTagSets)
+		}
+		if sets == nil {
+			sets = make(map[string]bool)
+			app.tagSets[name] = sets
+		}
+		sets[key] = true
+		app.tagSetCount++
+		app.overloadCheck()
+	}
+	tagged, has := app.tagged[key]
+	if !has {
+		tagged = CreateAppStatistic(app.name, app.logger)
+		tagged.maxMetrics = app.maxMetrics
+		app.tagged[key] = tagged
+	}
+	return tagged, nil
+}
+
+func (app *AppStatistic) Sum(name string, value float64) {
 	if app.overload {
 		return
 	}
 	app.mutex.Lock()
 	app.metrics[name] += value
+	app.kinds[name] = SumTag
 	app.overloadCheck()
 	app.mutex.Unlock()
 }
 
-func (app *AppStatistic) Avg(name string, value int) {
+func (app *AppStatistic) Avg(name string, value float64) {
 	if app.overload {
 		return
 	}
@@ -65,21 +145,25 @@ func (app *AppStatistic) Avg(name string, value int) {
 	app.metrics[name+"_sum"] += value
 	app.metrics[name+"_count"] += 1
 	app.metrics[name] = app.metrics[name+"_sum"] / app.metrics[name+"_count"]
+	app.kinds[name+"_sum"] = SumTag
+	app.kinds[name+"_count"] = SumTag
+	app.kinds[name] = AvgTag
 	app.overloadCheck()
 	app.mutex.Unlock()
 }
 
-func (app *AppStatistic) Set(name string, value int) {
+func (app *AppStatistic) Set(name string, value float64) {
 	if app.overload {
 		return
 	}
 	app.mutex.Lock()
 	app.metrics[name] = value
+	app.kinds[name] = SetTag
 	app.overloadCheck()
 	app.mutex.Unlock()
 }
 
-func (app *AppStatistic) Max(name string, value int) {
+func (app *AppStatistic) Max(name string, value float64) {
 	if app.overload {
 		return
 	}
@@ -87,11 +171,12 @@ func (app *AppStatistic) Max(name string, value int) {
 	if _, has := app.metrics[name]; !has || value > app.metrics[name] {
 		app.metrics[name] = value
 	}
+	app.kinds[name] = MaxTag
 	app.overloadCheck()
 	app.mutex.Unlock()
 }
 
-func (app *AppStatistic) Min(name string, value int) {
+func (app *AppStatistic) Min(name string, value float64) {
 	if app.overload {
 		return
 	}
@@ -99,69 +184,105 @@ func (app *AppStatistic) Min(name string, value int) {
 	if _, has := app.metrics[name]; !has || value < app.metrics[name] {
 		app.metrics[name] = value
 	}
+	app.kinds[name] = MinTag
 	app.overloadCheck()
 	app.mutex.Unlock()
 }
 
-func (app *AppStatistic) TakeIntMetrics() *map[string]int {
+func (app *AppStatistic) TakeIntMetrics() *map[string]MetricValue {
 	app.mutex.Lock()
 	defer app.mutex.Unlock()
-	result := make(map[string]int)
+	result := make(map[string]MetricValue)
 	for metric, value := range app.metrics {
-		result[metric] = value
+		result[metric] = MetricValue{Kind: app.kinds[metric], Value: value}
 	}
 	for metric, hll := range app.hll {
-		result[metric] = int(hll.Estimate())
+		result[metric] = MetricValue{Kind: HllTag, Value: float64(hll.Estimate())}
+	}
+	for key, tagged := range app.tagged {
+		for metric, value := range *tagged.TakeIntMetrics() {
+			result[joinTagged(metric, key)] = value
+		}
 	}
 	app.hll = make(map[string]*hyperloglog.Sketch)
-	app.metrics = make(map[string]int)
+	app.metrics = make(map[string]float64)
+	app.kinds = make(map[string]string)
+	app.tagSets = make(map[string]map[string]bool)
+	app.tagSetCount = 0
+	app.dropEmptyTagged()
 	app.overload = false
 	return &result
 }
 
-func (app *AppStatistic) TakeIntDayMetrics() *map[string]int {
+func (app *AppStatistic) TakeIntDayMetrics() *map[string]MetricValue {
 	app.mutex.Lock()
 	defer app.mutex.Unlock()
-	result := make(map[string]int)
+	result := make(map[string]MetricValue)
 	for metric, hll := range app.hllDay {
-		result[metric] = int(hll.Estimate())
+		result[metric] = MetricValue{Kind: HllDayTag, Value: float64(hll.Estimate())}
+	}
+	for key, tagged := range app.tagged {
+		for metric, value := range *tagged.TakeIntDayMetrics() {
+			result[joinTagged(metric, key)] = value
+		}
 	}
 	app.hllDay = make(map[string]*hyperloglog.Sketch)
+	app.dropEmptyTagged()
 	app.overload = false
 	return &result
 }
 
-func (app *AppStatistic) TakeStringMetrics() *map[string]map[string]int {
+func (app *AppStatistic) TakeStringMetrics() *map[string]PatternValues {
 	app.mutex.Lock()
 	defer app.mutex.Unlock()
-	result := make(map[string]map[string]int)
+	result := make(map[string]PatternValues)
 	for metric, cache := range app.patterns {
-		buff := make(map[string]int)
+		buff := make(map[string]float64)
 		keys := cache.Keys()
 		for _, keyRaw := range keys {
 			pattern, ok := keyRaw.(string)
 			if ok {
 				if valueRaw, ok := cache.Get(keyRaw); ok {
-					if value, ok := valueRaw.(int); ok {
+					if value, ok := valueRaw.(float64); ok {
 						buff[pattern] = value
-					} else if value, ok := valueRaw.([2]int); ok {
+					} else if value, ok := valueRaw.([2]float64); ok {
 						buff[pattern] = value[0] / value[1]
 					} else {
-						log.Printf("Cant cast value to int metric: %s, pattern: %s", metric, pattern)
+						app.logger.Error("bad pattern value", "app", app.name, "metric", metric, "pattern", pattern)
 					}
 				}
 			} else {
-				log.Printf("Cant cast pattern to string metric: %s", metric)
+				app.logger.Error("bad pattern key", "app", app.name, "metric", metric)
 			}
 		}
-		result[metric] = buff
+		result[metric] = PatternValues{Kind: app.patternKinds[metric], Values: buff}
+	}
+	for key, tagged := range app.tagged {
+		for metric, values := range *tagged.TakeStringMetrics() {
+			result[joinTagged(metric, key)] = values
+		}
 	}
 	app.patterns = make(map[string]*lru.Cache)
+	app.patternKinds = make(map[string]string)
+	app.dropEmptyTagged()
 	app.overload = false
 	return &result
 }
 
-func (app *AppStatistic) StrSum(name string, value int, pattern string) {
+// Tag sets are counted per flush, so children left with nothing to flush are dropped or every
+// flush could add MaxTagSets of them per metric until the day ends. Called with app.mutex held
+func (app *AppStatistic) dropEmptyTagged() {
+	for key, tagged := range app.tagged {
+		tagged.mutex.Lock()
+		empty := len(tagged.metrics) == 0 && len(tagged.hll) == 0 && len(tagged.hllDay) == 0 && len(tagged.patterns) == 0
+		tagged.mutex.Unlock()
+		if empty {
+			delete(app.tagged, key)
+		}
+	}
+}
+
+func (app *AppStatistic) StrSum(name string, value float64, pattern string) {
 	if app.overload {
 		return
 	}
@@ -169,7 +290,7 @@ func (app *AppStatistic) StrSum(name string, value int, pattern string) {
 	if cache, has := app.patterns[name]; has {
 		oldValueI, has := cache.Peek(pattern)
 		if has {
-			oldValue, ok := oldValueI.(int)
+			oldValue, ok := oldValueI.(float64)
 			if ok {
 				cache.Add(pattern, value+oldValue)
 			} else {
@@ -181,17 +302,18 @@ func (app *AppStatistic) StrSum(name string, value int, pattern string) {
 	} else {
 		cache, err := lru.New(PatternSize)
 		if err != nil {
-			log.Println("Fail create pattern cache for app", app.name, err)
+			app.logger.Error("pattern cache not created", "app", app.name, "metric", name, "error", err)
 		} else {
 			cache.Add(pattern, value)
 			app.patterns[name] = cache
 		}
 	}
+	app.patternKinds[name] = StrSumTag
 	app.overloadCheck()
 	app.mutex.Unlock()
 }
 
-func (app *AppStatistic) StrSet(name string, value int, pattern string) {
+func (app *AppStatistic) StrSet(name string, value float64, pattern string) {
 	if app.overload {
 		return
 	}
@@ -201,17 +323,18 @@ func (app *AppStatistic) StrSet(name string, value int, pattern string) {
 	} else {
 		cache, err := lru.New(PatternSize)
 		if err != nil {
-			log.Println("Fail create pattern cache for app", app.name, err)
+			app.logger.Error("pattern cache not created", "app", app.name, "metric", name, "error", err)
 		} else {
 			cache.Add(pattern, value)
 			app.patterns[name] = cache
 		}
 	}
+	app.patternKinds[name] = StrSetTag
 	app.overloadCheck()
 	app.mutex.Unlock()
 }
 
-func (app *AppStatistic) StrMin(name string, value int, pattern string) {
+func (app *AppStatistic) StrMin(name string, value float64, pattern string) {
 	if app.overload {
 		return
 	}
@@ -219,7 +342,7 @@ func (app *AppStatistic) StrMin(name string, value int, pattern string) {
 	if cache, has := app.patterns[name]; has {
 		oldValueI, has := cache.Peek(pattern)
 		if has {
-			oldValue, ok := oldValueI.(int)
+			oldValue, ok := oldValueI.(float64)
 			if ok && oldValue < value {
 				cache.Add(pattern, oldValue)
 			} else {
@@ -231,17 +354,18 @@ func (app *AppStatistic) StrMin(name string, value int, pattern string) {
 	} else {
 		cache, err := lru.New(PatternSize)
 		if err != nil {
-			log.Println("Fail create pattern cache for app", app.name, err)
+			app.logger.Error("pattern cache not created", "app", app.name, "metric", name, "error", err)
 		} else {
 			cache.Add(pattern, value)
 			app.patterns[name] = cache
 		}
 	}
+	app.patternKinds[name] = StrMinTag
 	app.overloadCheck()
 	app.mutex.Unlock()
 }
 
-func (app *AppStatistic) StrMax(name string, value int, pattern string) {
+func (app *AppStatistic) StrMax(name string, value float64, pattern string) {
 	if app.overload {
 		return
 	}
@@ -249,7 +373,7 @@ func (app *AppStatistic) StrMax(name string, value int, pattern string) {
 	if cache, has := app.patterns[name]; has {
 		oldValueI, has := cache.Peek(pattern)
 		if has {
-			oldValue, ok := oldValueI.(int)
+			oldValue, ok := oldValueI.(float64)
 			if ok && oldValue > value {
 				cache.Add(pattern, oldValue)
 			} else {
@@ -261,17 +385,18 @@ func (app *AppStatistic) StrMax(name string, value int, pattern string) {
 	} else {
 		cache, err := lru.New(PatternSize)
 		if err != nil {
-			log.Println("Fail create pattern cache for app", app.name, err)
+			app.logger.Error("pattern cache not created", "app", app.name, "metric", name, "error", err)
 		} else {
 			cache.Add(pattern, value)
 			app.patterns[name] = cache
 		}
 	}
+	app.patternKinds[name] = StrMaxTag
 	app.overloadCheck()
 	app.mutex.Unlock()
 }
 
-func (app *AppStatistic) StrAvg(name string, value int, pattern string) {
+func (app *AppStatistic) StrAvg(name string, value float64, pattern string) {
 	if app.overload {
 		return
 	}
@@ -279,26 +404,27 @@ func (app *AppStatistic) StrAvg(name string, value int, pattern string) {
 	if cache, has := app.patterns[name]; has {
 		oldValueI, has := cache.Peek(pattern)
 		if has {
-			oldValue, ok := oldValueI.([2]int)
+			oldValue, ok := oldValueI.([2]float64)
 			if ok {
 				sum := oldValue[0] + value
 				count := oldValue[1] + 1
-				cache.Add(pattern, [2]int{sum, count})
+				cache.Add(pattern, [2]float64{sum, count})
 			} else {
-				cache.Add(pattern, [2]int{value, 1})
+				cache.Add(pattern, [2]float64{value, 1})
 			}
 		} else {
-			cache.Add(pattern, [2]int{value, 1})
+			cache.Add(pattern, [2]float64{value, 1})
 		}
 	} else {
 		cache, err := lru.New(PatternSize)
 		if err != nil {
-			log.Println("Fail create pattern cache for app", app.name, err)
+			app.logger.Error("pattern cache not created", "app", app.name, "metric", name, "error", err)
 		} else {
-			cache.Add(pattern, [2]int{value, 1})
+			cache.Add(pattern, [2]float64{value, 1})
 			app.patterns[name] = cache
 		}
 	}
+	app.patternKinds[name] = StrAvgTag
 	app.overloadCheck()
 	app.mutex.Unlock()
 }
@@ -335,6 +461,107 @@ func (app *AppStatistic) HllDay(name, pattern string) {
 	app.mutex.Unlock()
 }
 
+// AppSnapshot is a copy of what the app holds now, taking it does not reset anything
+type AppSnapshot struct {
+	Metrics  map[string]MetricValue
+	Day      map[string]MetricValue
+	Strings  map[string]PatternValues
+	Overload bool
+}
+
+func (app *AppStatistic) Snapshot() AppSnapshot {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	snapshot := AppSnapshot{
+		Metrics:  make(map[string]MetricValue, len(app.metrics)+len(app.hll)),
+		Day:      make(map[string]MetricValue, len(app.hllDay)),
+		Strings:  make(map[string]PatternValues, len(app.patterns)),
+		Overload: app.overload,
+	}
+	for metric, value := range app.metrics {
+		snapshot.Metrics[metric] = MetricValue{Kind: app.kinds[metric], Value: value}
+	}
+	for metric, hll := range app.hll {
+		snapshot.Metrics[metric] = MetricValue{Kind: HllTag, Value: float64(hll.Estimate())}
+	}
+	for metric, hll := range app.hllDay {
+		snapshot.Day[metric] = MetricValue{Kind: HllDayTag, Value: float64(hll.Estimate())}
+	}
+	for metric, cache := range app.patterns {
+		buff := make(map[string]float64, cache.Len())
+		for _, keyRaw := range cache.Keys() {
+			pattern, ok := keyRaw.(string)
+			if !ok {
+				continue
+			}
+			valueRaw, ok := cache.Peek(keyRaw)
+			if !ok {
+				continue
+			}
+			if value, ok := valueRaw.(float64); ok {
+				buff[pattern] = value
+			} else if value, ok := valueRaw.([2]float64); ok {
+				buff[pattern] = value[0] / value[1]
+			}
+		}
+		snapshot.Strings[metric] = PatternValues{Kind: app.patternKinds[metric], Values: buff}
+	}
+	for key, tagged := range app.tagged {
+		tagSnapshot := tagged.Snapshot()
+		for metric, value := range tagSnapshot.Metrics {
+			snapshot.Metrics[joinTagged(metric, key)] = value
+		}
+		for metric, value := range tagSnapshot.Day {
+			snapshot.Day[joinTagged(metric, key)] = value
+		}
+		for metric, values := range tagSnapshot.Strings {
+			snapshot.Strings[joinTagged(metric, key)] = values
+		}
+		snapshot.Overload = snapshot.Overload || tagSnapshot.Overload
+	}
+	return snapshot
+}
+
+// Rough per entry cost of a map or cache slot without its key, used by MemoryEstimate
+const entryOverhead = 64
+
+// A New16 sketch has 2^16 four bit registers once dense, sparse ones are smaller so this is the
+// most a sketch holds
+const hllSketchBytes = 1 << 16 / 2
+
+// MemoryEstimate approximates bytes held by the app, hll sketches are counted as dense ones
+// so the estimate needs no more than the lock held while counting entries
+func (app *AppStatistic) MemoryEstimate() int {
+	app.mutex.Lock()
+	size := 0
+	for name := range app.metrics {
+		size += len(name) + entryOverhead
+	}
+	for name, cache := range app.patterns {
+		size += len(name) + entryOverhead
+		for _, keyRaw := range cache.Keys() {
+			if pattern, ok := keyRaw.(string); ok {
+				size += len(pattern) + entryOverhead
+			}
+		}
+	}
+	for _, sketches := range []map[string]*hyperloglog.Sketch{app.hll, app.hllDay} {
+		for name := range sketches {
+			size += len(name) + hllSketchBytes + entryOverhead
+		}
+	}
+	tagged := make([]*AppStatistic, 0, len(app.tagged))
+	for key, child := range app.tagged {
+		size += len(key) + entryOverhead
+		tagged = append(tagged, child)
+	}
+	app.mutex.Unlock()
+	for _, child := range tagged {
+		size += child.MemoryEstimate()
+	}
+	return size
+}
+
 func (app *AppStatistic) GetData() map[string][]byte {
 	app.mutex.Lock()
 	defer app.mutex.Unlock()
@@ -344,22 +571,42 @@ func (app *AppStatistic) GetData() map[string][]byte {
 		if err == nil {
 			buff[key] = tmp
 		} else {
-			log.Println("Fail marshal data", key, err)
+			app.logger.Error("marshal day metric failed", "app", app.name, "metric", key, "error", err)
+		}
+	}
+	for tagKey, tagged := range app.tagged {
+		for key, data := range tagged.GetData() {
+			buff[joinTagged(key, tagKey)] = data
 		}
 	}
 	return buff
 }
 
 func (app *AppStatistic) RestoreData(res map[string][]byte) {
+	for key, data := range res {
+		name, tags := splitTaggedName(key)
+		if len(tags) == 0 {
+			continue
+		}
+		tagged, err := app.Tagged(name, tags)
+		if err != nil {
+			app.logger.Warn("restore day metric failed", "app", app.name, "metric", key, "error", err)
+			continue
+		}
+		tagged.RestoreData(map[string][]byte{name: data})
+	}
 	app.mutex.Lock()
 	defer app.mutex.Unlock()
 	for key, data := range res {
+		if strings.Contains(key, ";") {
+			continue
+		}
 		h := hyperloglog.New16()
 		err := h.UnmarshalBinary(data)
 		if err == nil {
 			app.hllDay[key] = h
 		} else {
-			log.Println("Fail unmarshal data", key, err)
+			app.logger.Warn("unmarshal day metric failed", "app", app.name, "metric", key, "error", err)
 		}
 	}
 }
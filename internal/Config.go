@@ -0,0 +1,463 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Used when neither -config nor CONFIG name a file, it may be missing
+const DefaultConfigFile = "config.json"
+
+// Config holds every setting of the proxy. A field is taken from, in increasing priority, its
+// default, the config file, the environment variable named by its name tag and the command
+// line flag of the same name in lower case with - instead of _, like -admin-http
+type Config struct {
+	App         string `name:"APP" default:"dev_log_saver/0" help:"AppName/nodeId the proxy reports itself as"`
+	SelfApp     string `name:"SELF_APP" help:"app of self-monitoring metrics, APP when empty"`
+	LogAddress  string `name:"LOG_ADDRESS" default:"127.0.0.1:1007" help:"UDP address start and save counters are sent to"`
+	AccessToken string `name:"ACCESS_TOKEN" secret:"1" help:"VK token for group names"`
+
+	LogLevel  string `name:"LOG_LEVEL" default:"info" help:"lowest level logged: debug, info, warn or error"`
+	LogFormat string `name:"LOG_FORMAT" default:"text" help:"log lines as text or json"`
+	LogRate   int    `name:"LOG_RATE" default:"10" help:"times a minute the same message is logged, 0 logs all"`
+
+	Udp        string `name:"UDP" help:"host:port of the RL protocol listener"`
+	MaxMetrics int    `name:"MAX_METRICS" default:"70" help:"metrics of each kind an app may hold between flushes"`
+	AppLimits  string `name:"APP_LIMITS" help:"name:limit pairs separated by ; overriding MAX_METRICS for single apps"`
+	UdpAllow   string `name:"UDP_ALLOW" help:"comma separated networks UDP accepts packets from, all when empty"`
+	UdpDeny    string `name:"UDP_DENY" help:"comma separated networks UDP drops packets from"`
+	UdpApps    string `name:"UDP_APPS" help:"network=prefix|prefix pairs separated by ; limiting the apps a network may write over UDP"`
+	UdpRate    int    `name:"UDP_RATE" help:"packets a second each source may send to UDP, 0 is unlimited"`
+
+	GraphiteUdp   string `name:"GRAPHITE_UDP" help:"host:port of the Graphite plaintext UDP listener"`
+	GraphiteTcp   string `name:"GRAPHITE_TCP" help:"host:port of the Graphite plaintext TCP listener"`
+	GraphiteRules string `name:"GRAPHITE_RULES" default:"app.metric*" help:"Graphite path templates separated by ;"`
+
+	InfluxUdp         string `name:"INFLUX_UDP" help:"host:port of the Influx line protocol UDP listener"`
+	InfluxTcp         string `name:"INFLUX_TCP" help:"host:port of the Influx line protocol TCP listener"`
+	InfluxAppTag      string `name:"INFLUX_APP_TAG" default:"app" help:"Influx tag with the app name"`
+	InfluxNodeTag     string `name:"INFLUX_NODE_TAG" default:"host" help:"Influx tag with the node"`
+	InfluxPatternTags string `name:"INFLUX_PATTERN_TAGS" help:"comma separated Influx tags joined into the pattern"`
+	InfluxKind        string `name:"INFLUX_KIND" default:"S" help:"kind of Influx fields"`
+
+	OtlpHttp string `name:"OTLP_HTTP" help:"host:port of the OTLP/HTTP metrics receiver"`
+
+	Http          string `name:"HTTP" help:"host:port of the collector HTTP server"`
+	Postgres      string `name:"POSTGRES" secret:"url" help:"Postgres connection url"`
+	Secret        string `name:"SECRET" default:"secret" secret:"1" help:"key of the collector HTTP server"`
+	PromAppLabel  string `name:"PROM_APP_LABEL" default:"job" help:"remote_write label with the app name"`
+	PromNodeLabel string `name:"PROM_NODE_LABEL" default:"instance" help:"remote_write label with the node"`
+
+	AlertRules       string  `name:"ALERT_RULES" help:"json file with alert rules"`
+	AlertWebhook     string  `name:"ALERT_WEBHOOK" help:"url alerts are posted to"`
+	AlertInterval    int     `name:"ALERT_INTERVAL" default:"60" help:"seconds of stored data alert rules are checked over"`
+	HeartbeatGrace   int     `name:"HEARTBEAT_GRACE" help:"seconds an app node may be silent, 0 turns heartbeat off"`
+	AnomalyMetrics   string  `name:"ANOMALY_METRICS" help:"app:metric[:pattern] targets separated by ;"`
+	AnomalyInterval  int     `name:"ANOMALY_INTERVAL" default:"10" help:"minutes between anomaly checks"`
+	AnomalyDeviation float64 `name:"ANOMALY_DEVIATION" default:"4" help:"score an anomaly alert fires above"`
+
+	Rollup            bool   `name:"ROLLUP" help:"run the rollup service"`
+	RollupInterval    int    `name:"ROLLUP_INTERVAL" default:"10" help:"minutes between rollups"`
+	RollupDelay       int    `name:"ROLLUP_DELAY" default:"5" help:"minutes rows may arrive late, hours are rolled up once they are this old"`
+	RawRetentionDays  int    `name:"RAW_RETENTION_DAYS" help:"days raw rows are kept, 0 keeps them"`
+	RollupDefaultKind string `name:"ROLLUP_DEFAULT_KIND" default:"P" help:"kind of rows stored without one"`
+
+	ProxyTo  string `name:"PROXY_TO" help:"collector url metrics are flushed to"`
+	SaveTime int    `name:"SAVE_TIME" default:"60" help:"seconds between flushes"`
+	TmpFile  string `name:"TMP_FILE" default:"./data.tmp" help:"file unsent data is kept in between restarts"`
+
+	AdminHttp string `name:"ADMIN_HTTP" help:"host:port of the admin listener"`
+
+	StopTimeout     int `name:"STOP_TIMEOUT" default:"10" help:"seconds a service may take to stop"`
+	ShutdownTimeout int `name:"SHUTDOWN_TIMEOUT" default:"30" help:"seconds all services may take to stop, the final flush included"`
+
+	// setting name to where its value came from: default, file, env or flag
+	sources map[string]string
+	file    string
+}
+
+// LoadConfig reads the config file, environment and flags in args. The returned config is
+// usable for printing even with an error, which then lists every bad setting
+func LoadConfig(args []string) (*Config, error) {
+	config := &Config{sources: make(map[string]string)}
+	fields := configFields()
+
+	flags := flag.NewFlagSet("stat-proxy", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	configFile := flags.String("config", "", "config file, json or flat yaml (CONFIG)")
+	flagValues := make(map[string]*string, len(fields))
+	for _, field := range fields {
+		flagValues[field.name] = flags.String(field.flag(), "", field.help)
+	}
+	if err := flags.Parse(args); err != nil {
+		var usage strings.Builder
+		flags.SetOutput(&usage)
+		flags.PrintDefaults()
+		return config, fmt.Errorf("%s\n%s", err, usage.String())
+	}
+	flagSet := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		flagSet[f.Name] = true
+	})
+
+	var problems []string
+	file, explicit := *configFile, true
+	if file == "" {
+		file = os.Getenv("CONFIG")
+	}
+	if file == "" {
+		file, explicit = DefaultConfigFile, false
+	}
+	fileValues, err := readConfigFile(file)
+	if err != nil {
+		if explicit || !os.IsNotExist(err) {
+			problems = append(problems, err.Error())
+		}
+	} else {
+		config.file = file
+	}
+	known := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		known[field.name] = true
+	}
+	for name := range fileValues {
+		if !known[name] {
+			problems = append(problems, fmt.Sprintf("%s: unknown setting %s", file, name))
+		}
+	}
+
+	target := reflect.ValueOf(config).Elem()
+	for _, field := range fields {
+		value, source := field.def, "default"
+		if fileValue, has := fileValues[field.name]; has {
+			value, source = fileValue, "file"
+		}
+		if envValue := os.Getenv(field.name); envValue != "" {
+			value, source = envValue, "env"
+		}
+		if flagSet[field.flag()] {
+			value, source = *flagValues[field.name], "flag"
+		}
+		config.sources[field.name] = source
+		if err := field.set(target.Field(field.index), value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s=%q from %s: %s", field.name, value, source, err))
+		}
+	}
+	problems = append(problems, config.validate()...)
+	if len(problems) > 0 {
+		return config, errors.New(strings.Join(problems, "\n"))
+	}
+	return config, nil
+}
+
+// SelfAppName is the app self-monitoring metrics are kept under
+func (config *Config) SelfAppName() string {
+	if config.SelfApp == "" {
+		return config.App
+	}
+	return config.SelfApp
+}
+
+// AppLimitMap is APP_LIMITS parsed, it was validated on load
+func (config *Config) AppLimitMap() map[string]int {
+	limits, _ := ParseAppLimits(config.AppLimits)
+	return limits
+}
+
+// UdpAccess is UDP_ALLOW, UDP_DENY and UDP_APPS parsed, they were validated on load
+func (config *Config) UdpAccess() *UdpAcl {
+	acl, _ := ParseUdpAcl(config.UdpAllow, config.UdpDeny, config.UdpApps)
+	return acl
+}
+
+func (config *Config) validate() []string {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(isValidAppName(config.App), "APP=%q: expected AppName/nodeId like api/1", config.App)
+	check(config.SelfApp == "" || isValidAppName(config.SelfApp), "SELF_APP=%q: expected AppName/nodeId like api/1", config.SelfApp)
+	if _, err := ParseLogLevel(config.LogLevel); err != nil {
+		problems = append(problems, fmt.Sprintf("LOG_LEVEL=%q: %s", config.LogLevel, err))
+	}
+	check(config.LogFormat == "text" || config.LogFormat == "json", "LOG_FORMAT=%q: expected text or json", config.LogFormat)
+	check(config.LogRate >= 0, "LOG_RATE=%d: must not be negative", config.LogRate)
+	addresses := []struct {
+		name, value string
+	}{
+		{"LOG_ADDRESS", config.LogAddress},
+		{"UDP", config.Udp},
+		{"GRAPHITE_UDP", config.GraphiteUdp},
+		{"GRAPHITE_TCP", config.GraphiteTcp},
+		{"INFLUX_UDP", config.InfluxUdp},
+		{"INFLUX_TCP", config.InfluxTcp},
+		{"OTLP_HTTP", config.OtlpHttp},
+		{"HTTP", config.Http},
+		{"ADMIN_HTTP", config.AdminHttp},
+	}
+	for _, address := range addresses {
+		if err := checkAddress(address.value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s=%q: %s", address.name, address.value, err))
+		}
+	}
+	if err := checkHttpUrl(config.ProxyTo); err != nil {
+		problems = append(problems, fmt.Sprintf("PROXY_TO=%q: %s", config.ProxyTo, err))
+	}
+	if err := checkHttpUrl(config.AlertWebhook); err != nil {
+		problems = append(problems, fmt.Sprintf("ALERT_WEBHOOK=%q: %s", config.AlertWebhook, err))
+	}
+	check(config.MaxMetrics >= 1, "MAX_METRICS=%d: must be at least 1", config.MaxMetrics)
+	if _, err := ParseAppLimits(config.AppLimits); err != nil {
+		problems = append(problems, fmt.Sprintf("APP_LIMITS=%q: %s", config.AppLimits, err))
+	}
+	if _, err := parseNetworks(config.UdpAllow); err != nil {
+		problems = append(problems, fmt.Sprintf("UDP_ALLOW=%q: %s", config.UdpAllow, err))
+	}
+	if _, err := parseNetworks(config.UdpDeny); err != nil {
+		problems = append(problems, fmt.Sprintf("UDP_DENY=%q: %s", config.UdpDeny, err))
+	}
+	if _, err := ParseUdpAcl("", "", config.UdpApps); err != nil {
+		problems = append(problems, fmt.Sprintf("UDP_APPS=%q: %s", config.UdpApps, err))
+	}
+	check(config.UdpRate >= 0, "UDP_RATE=%d: must not be negative", config.UdpRate)
+	check(config.SaveTime > 1, "SAVE_TIME=%d: must be above 1 second", config.SaveTime)
+	check(config.StopTimeout >= 1, "STOP_TIMEOUT=%d: must be at least 1 second", config.StopTimeout)
+	check(config.ShutdownTimeout >= config.StopTimeout, "SHUTDOWN_TIMEOUT=%d: must not be below STOP_TIMEOUT", config.ShutdownTimeout)
+	check(config.AlertInterval >= 1, "ALERT_INTERVAL=%d: must be at least 1 second", config.AlertInterval)
+	check(config.HeartbeatGrace >= 0, "HEARTBEAT_GRACE=%d: must not be negative", config.HeartbeatGrace)
+	check(config.AnomalyInterval >= 1, "ANOMALY_INTERVAL=%d: must be at least 1 minute", config.AnomalyInterval)
+	check(config.AnomalyDeviation > 0, "ANOMALY_DEVIATION=%g: must be above 0", config.AnomalyDeviation)
+	check(config.RollupInterval >= 1, "ROLLUP_INTERVAL=%d: must be at least 1 minute", config.RollupInterval)
+	check(!config.Rollup || config.RollupDelay*60 > config.SaveTime, "ROLLUP_DELAY=%d: must be above SAVE_TIME", config.RollupDelay)
+	check(config.RawRetentionDays >= 0, "RAW_RETENTION_DAYS=%d: must not be negative", config.RawRetentionDays)
+	_, has := stringTags[config.InfluxKind]
+	check(has, "INFLUX_KIND=%q: expected one of P S M I A", config.InfluxKind)
+	_, has = rollupAggregates[config.RollupDefaultKind]
+	check(has, "ROLLUP_DEFAULT_KIND=%q: expected one of P S M I A", config.RollupDefaultKind)
+
+	check(config.Http == "" || config.Postgres != "", "HTTP needs POSTGRES")
+	check(!config.Rollup || config.Postgres != "", "ROLLUP needs POSTGRES")
+	check(config.AlertRules == "" || config.Http != "", "ALERT_RULES needs HTTP")
+	check(config.HeartbeatGrace == 0 || config.Http != "", "HEARTBEAT_GRACE needs HTTP")
+	check(config.AnomalyMetrics == "" || config.Http != "", "ANOMALY_METRICS needs HTTP")
+	if config.AnomalyMetrics != "" {
+		if _, err := ParseAnomalyTargets(config.AnomalyMetrics); err != nil {
+			problems = append(problems, fmt.Sprintf("ANOMALY_METRICS=%q: %s", config.AnomalyMetrics, err))
+		}
+	}
+	if config.GraphiteUdp != "" || config.GraphiteTcp != "" {
+		if _, err := CreateGraphiteParser(config.GraphiteRules); err != nil {
+			problems = append(problems, fmt.Sprintf("GRAPHITE_RULES=%q: %s", config.GraphiteRules, err))
+		}
+	}
+	return problems
+}
+
+func checkAddress(value string) error {
+	if value == "" {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return errors.New("expected host:port")
+	}
+	if number, err := strconv.Atoi(port); err != nil || number < 0 || number > 65535 {
+		return fmt.Errorf("bad port %s", port)
+	}
+	return nil
+}
+
+func checkHttpUrl(value string) error {
+	if value == "" {
+		return nil
+	}
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errors.New("expected http:// or https:// url")
+	}
+	return nil
+}
+
+// Print writes the effective configuration, one NAME=value per line with where it came from.
+// Secrets are masked
+func (config *Config) Print(w io.Writer) {
+	if config.file != "" {
+		fmt.Fprintf(w, "# file %s\n", config.file)
+	}
+	target := reflect.ValueOf(config).Elem()
+	for _, field := range configFields() {
+		fmt.Fprintf(w, "%s=%s # %s\n", field.name, field.format(target.Field(field.index)), config.sources[field.name])
+	}
+}
+
+type configField struct {
+	index  int
+	name   string
+	def    string
+	help   string
+	secret string
+}
+
+func configFields() []configField {
+	var fields []configField
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		name := field.Tag.Get("name")
+		if name == "" {
+			continue
+		}
+		fields = append(fields, configField{
+			index:  i,
+			name:   name,
+			def:    field.Tag.Get("default"),
+			help:   field.Tag.Get("help") + " (" + name + ")",
+			secret: field.Tag.Get("secret"),
+		})
+	}
+	return fields
+}
+
+func (field configField) flag() string {
+	return strings.ReplaceAll(strings.ToLower(field.name), "_", "-")
+}
+
+func (field configField) set(target reflect.Value, value string) error {
+	value = strings.TrimSpace(value)
+	switch target.Kind() {
+	case reflect.String:
+		target.SetString(value)
+	case reflect.Int:
+		if value == "" {
+			value = "0"
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("expected an integer")
+		}
+		target.SetInt(int64(number))
+	case reflect.Float64:
+		if value == "" {
+			value = "0"
+		}
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.New("expected a number")
+		}
+		target.SetFloat(number)
+	case reflect.Bool:
+		if value == "" {
+			value = "false"
+		}
+		flag, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("expected true or false")
+		}
+		target.SetBool(flag)
+	}
+	return nil
+}
+
+func (field configField) format(value reflect.Value) string {
+	raw := fmt.Sprint(value.Interface())
+	if raw == "" || field.secret == "" {
+		return raw
+	}
+	if field.secret == "url" {
+		if parsed, err := url.Parse(raw); err == nil && parsed.User != nil {
+			return parsed.Redacted()
+		}
+	}
+	return "***"
+}
+
+// Keys are setting names, json values may be strings, numbers or booleans. Files ending in
+// .yaml or .yml hold one NAME: value per line
+func readConfigFile(file string) (map[string]string, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]string
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		values, err = parseFlatYaml(raw)
+	default:
+		values, err = parseConfigJson(raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	result := make(map[string]string, len(values))
+	for key, value := range values {
+		result[strings.ToUpper(strings.ReplaceAll(key, "-", "_"))] = value
+	}
+	return result, nil
+}
+
+func parseConfigJson(raw []byte) (map[string]string, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(values))
+	for key, value := range values {
+		switch typed := value.(type) {
+		case string:
+			result[key] = typed
+		case float64:
+			result[key] = strconv.FormatFloat(typed, 'f', -1, 64)
+		case bool:
+			result[key] = strconv.FormatBool(typed)
+		case nil:
+			result[key] = ""
+		default:
+			return nil, fmt.Errorf("%s: expected a string, number or boolean", key)
+		}
+	}
+	return result, nil
+}
+
+func parseFlatYaml(raw []byte) (map[string]string, error) {
+	result := make(map[string]string)
+	for i, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "---" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("line %d: expected NAME: value", i+1)
+		}
+		value := strings.TrimSpace(parts[1])
+		switch {
+		case strings.HasPrefix(value, `"`):
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad quoted value", i+1)
+			}
+			value = unquoted
+		case strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") && len(value) > 1:
+			value = strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+		default:
+			if index := strings.Index(value, " #"); index != -1 {
+				value = strings.TrimSpace(value[:index])
+			}
+		}
+		result[strings.TrimSpace(parts[0])] = value
+	}
+	return result, nil
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFlatYaml(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "empty", raw: "", want: map[string]string{}},
+		{
+			name: "plain values, comments and document marker",
+			raw:  "---\n# settings\nUDP: 0.0.0.0:1007\nMAX_METRICS: 100 # per app\n\n",
+			want: map[string]string{"UDP": "0.0.0.0:1007", "MAX_METRICS": "100"},
+		},
+		{
+			name: "quoted values keep # and spaces",
+			raw:  "SECRET: \"a #b\\n\"\nAPP_LIMITS: 'api:500; it''s'\n",
+			want: map[string]string{"SECRET": "a #b\n", "APP_LIMITS": "api:500; it's"},
+		},
+		{
+			name: "empty value",
+			raw:  "PROXY_TO:",
+			want: map[string]string{"PROXY_TO": ""},
+		},
+		{name: "no colon", raw: "UDP 0.0.0.0", wantErr: true},
+		{name: "no name", raw: ": value", wantErr: true},
+		{name: "bad quotes", raw: "SECRET: \"open", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseFlatYaml([]byte(test.raw))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	yamlFile := write("config.yaml", "MAX_METRICS: 100\nudp: 0.0.0.0:1007\n")
+	jsonFile := write("config.json", `{"MAX_METRICS": 100, "rollup": true, "save-time": "30"}`)
+	unknownFile := write("unknown.json", `{"NO_SUCH_SETTING": 1}`)
+
+	tests := []struct {
+		name       string
+		args       []string
+		env        map[string]string
+		wantMax    int
+		wantSource string
+		wantErr    string
+		check      func(config *Config) bool
+	}{
+		{name: "defaults", wantMax: 70, wantSource: "default"},
+		{
+			name:       "yaml file",
+			args:       []string{"-config", yamlFile},
+			wantMax:    100,
+			wantSource: "file",
+			check:      func(config *Config) bool { return config.Udp == "0.0.0.0:1007" },
+		},
+		{
+			name:       "json file with numbers, booleans and dashed names",
+			args:       []string{"-config", jsonFile},
+			env:        map[string]string{"POSTGRES": "postgres://localhost/stat"},
+			wantMax:    100,
+			wantSource: "file",
+			check:      func(config *Config) bool { return config.Rollup && config.SaveTime == 30 },
+		},
+		{
+			name:       "env over file",
+			env:        map[string]string{"CONFIG": yamlFile, "MAX_METRICS": "200"},
+			wantMax:    200,
+			wantSource: "env",
+		},
+		{
+			name:       "flag over env",
+			args:       []string{"-config", yamlFile, "-max-metrics", "300"},
+			env:        map[string]string{"MAX_METRICS": "200"},
+			wantMax:    300,
+			wantSource: "flag",
+		},
+		{name: "unknown setting in file", args: []string{"-config", unknownFile}, wantErr: "unknown setting NO_SUCH_SETTING"},
+		{name: "missing explicit file", args: []string{"-config", filepath.Join(dir, "missing.json")}, wantErr: "missing.json"},
+		{name: "bad number", args: []string{"-max-metrics", "many"}, wantErr: "MAX_METRICS"},
+		{name: "failed validation", env: map[string]string{"SAVE_TIME": "1"}, wantErr: "SAVE_TIME=1"},
+		{name: "unknown flag", args: []string{"-no-such-flag"}, wantErr: "no-such-flag"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				os.Setenv(name, value)
+			}
+			defer func() {
+				for name := range test.env {
+					os.Unsetenv(name)
+				}
+			}()
+			config, err := LoadConfig(test.args)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error %v, want one with %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.MaxMetrics != test.wantMax || config.sources["MAX_METRICS"] != test.wantSource {
+				t.Errorf("MAX_METRICS %d from %s, want %d from %s", config.MaxMetrics, config.sources["MAX_METRICS"], test.wantMax, test.wantSource)
+			}
+			if test.check != nil && !test.check(config) {
+				t.Errorf("unexpected config %+v", config)
+			}
+		})
+	}
+}
@@ -1,19 +1,97 @@
 package internal
 
-import "sync"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
 
 type CoreStatistic struct {
-	mutex sync.RWMutex
-	apps  map[string]*AppStatistic
+	mutex      sync.RWMutex
+	apps       map[string]*AppStatistic
+	tail       *TailHub
+	self       *SelfStat
+	logger     *Logger
+	maxMetrics int
+	appLimits  map[string]int
 }
 
-func CreateCoreStatistic() *CoreStatistic {
+func CreateCoreStatistic(logger *Logger) *CoreStatistic {
 	return &CoreStatistic{
-		apps:  make(map[string]*AppStatistic),
-		mutex: sync.RWMutex{},
+		apps:       make(map[string]*AppStatistic),
+		mutex:      sync.RWMutex{},
+		tail:       CreateTailHub(),
+		logger:     logger.Named("CoreStatistic"),
+		maxMetrics: MaxMetricCount,
 	}
 }
 
+// ParseAppLimits reads name:limit pairs separated by ;, name is AppName or AppName/nodeId
+func ParseAppLimits(value string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, raw := range strings.Split(value, ";") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		index := strings.LastIndex(raw, ":")
+		if index <= 0 {
+			return nil, fmt.Errorf("bad app limit %s, expected name:limit", raw)
+		}
+		limit, err := strconv.Atoi(raw[index+1:])
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("bad app limit %s, expected a positive number", raw)
+		}
+		limits[raw[:index]] = limit
+	}
+	return limits, nil
+}
+
+// SetLimits changes how many metrics of each kind an app may hold between flushes, limits
+// override maxMetrics for single apps. Apps already in memory take them too
+func (core *CoreStatistic) SetLimits(maxMetrics int, limits map[string]int) {
+	core.mutex.Lock()
+	core.maxMetrics = maxMetrics
+	core.appLimits = limits
+	apps := make(map[*AppStatistic]int, len(core.apps))
+	for name, app := range core.apps {
+		apps[app] = core.limitFor(name)
+	}
+	core.mutex.Unlock()
+	for app, limit := range apps {
+		app.SetMaxMetrics(limit)
+	}
+}
+
+// MaxMetrics is the limit of apps without their own
+func (core *CoreStatistic) MaxMetrics() int {
+	core.mutex.RLock()
+	defer core.mutex.RUnlock()
+	return core.maxMetrics
+}
+
+// Callers hold the mutex
+func (core *CoreStatistic) limitFor(name string) int {
+	if limit, has := core.appLimits[name]; has {
+		return limit
+	}
+	if limit, has := core.appLimits[strings.SplitN(name, "/", 2)[0]]; has {
+		return limit
+	}
+	return core.maxMetrics
+}
+
+// Tail streams every applied record
+func (core *CoreStatistic) Tail() *TailHub {
+	return core.tail
+}
+
+// SetSelfStat makes Apply count apps that became overloaded
+func (core *CoreStatistic) SetSelfStat(self *SelfStat) {
+	core.self = self
+}
+
 func (core *CoreStatistic) GetApp(name string) *AppStatistic {
 	core.mutex.RLock()
 	if app, has := core.apps[name]; has {
@@ -21,45 +99,46 @@ func (core *CoreStatistic) GetApp(name string) *AppStatistic {
 		return app
 	}
 	core.mutex.RUnlock()
-	newApp := CreateAppStatistic(name)
+	newApp := CreateAppStatistic(name, core.logger)
 	core.mutex.Lock()
 	defer core.mutex.Unlock()
 	if app, has := core.apps[name]; has {
 		return app
 	} else {
+		newApp.maxMetrics = core.limitFor(name)
 		core.apps[name] = newApp
 		return newApp
 	}
 }
 
-func (core *CoreStatistic) Sum(appName, param string, value int) {
+func (core *CoreStatistic) Sum(appName, param string, value float64) {
 	core.GetApp(appName).Sum(param, value)
 }
-func (core *CoreStatistic) Set(appName, param string, value int) {
+func (core *CoreStatistic) Set(appName, param string, value float64) {
 	core.GetApp(appName).Set(param, value)
 }
-func (core *CoreStatistic) Max(appName, param string, value int) {
+func (core *CoreStatistic) Max(appName, param string, value float64) {
 	core.GetApp(appName).Max(param, value)
 }
-func (core *CoreStatistic) Min(appName, param string, value int) {
+func (core *CoreStatistic) Min(appName, param string, value float64) {
 	core.GetApp(appName).Min(param, value)
 }
-func (core *CoreStatistic) Avg(appName, param string, value int) {
+func (core *CoreStatistic) Avg(appName, param string, value float64) {
 	core.GetApp(appName).Avg(param, value)
 }
-func (core *CoreStatistic) StrSum(appName, param string, value int, pattern string) {
+func (core *CoreStatistic) StrSum(appName, param string, value float64, pattern string) {
 	core.GetApp(appName).StrSum(param, value, pattern)
 }
-func (core *CoreStatistic) StrSet(appName, param string, value int, pattern string) {
+func (core *CoreStatistic) StrSet(appName, param string, value float64, pattern string) {
 	core.GetApp(appName).StrSet(param, value, pattern)
 }
-func (core *CoreStatistic) StrMin(appName, param string, value int, pattern string) {
+func (core *CoreStatistic) StrMin(appName, param string, value float64, pattern string) {
 	core.GetApp(appName).StrMin(param, value, pattern)
 }
-func (core *CoreStatistic) StrMax(appName, param string, value int, pattern string) {
+func (core *CoreStatistic) StrMax(appName, param string, value float64, pattern string) {
 	core.GetApp(appName).StrMax(param, value, pattern)
 }
-func (core *CoreStatistic) StrAvg(appName, param string, value int, pattern string) {
+func (core *CoreStatistic) StrAvg(appName, param string, value float64, pattern string) {
 	core.GetApp(appName).StrAvg(param, value, pattern)
 }
 func (core *CoreStatistic) Hll(appName, param string, pattern string) {
@@ -69,8 +148,58 @@ func (core *CoreStatistic) HllDay(appName, param string, pattern string) {
 	core.GetApp(appName).HllDay(param, pattern)
 }
 
-func (core *CoreStatistic) TakeIntMetrics() *map[string]*map[string]int {
-	result := make(map[string]*map[string]int)
+// Apply routes a record to its app, or to the statistic of its tag set when it has tags
+func (core *CoreStatistic) Apply(record Record) error {
+	parent := core.GetApp(record.App)
+	parentOverloaded := parent.IsOverloaded()
+	app := parent
+	if len(record.Tags) > 0 {
+		tagged, err := parent.Tagged(record.Param, record.Tags)
+		if err != nil {
+			return recordError("tag_limit", "%s %s", err, record.App)
+		}
+		app = tagged
+	}
+	overloaded := app.IsOverloaded()
+	switch record.Type {
+	case SetTag:
+		app.Set(record.Param, record.Value)
+	case SumTag:
+		app.Sum(record.Param, record.Value)
+	case MaxTag:
+		app.Max(record.Param, record.Value)
+	case MinTag:
+		app.Min(record.Param, record.Value)
+	case AvgTag:
+		app.Avg(record.Param, record.Value)
+	case HllDayTag:
+		app.HllDay(record.Param, record.Pattern)
+	case HllTag:
+		app.Hll(record.Param, record.Pattern)
+	case StrSetTag:
+		app.StrSet(record.Param, record.Value, record.Pattern)
+	case StrMinTag:
+		app.StrMin(record.Param, record.Value, record.Pattern)
+	case StrMaxTag:
+		app.StrMax(record.Param, record.Value, record.Pattern)
+	case StrAvgTag:
+		app.StrAvg(record.Param, record.Value, record.Pattern)
+	case StrSumTag:
+		app.StrSum(record.Param, record.Value, record.Pattern)
+	default:
+		return recordError("unknown_type", "Unknown param type: [%s] %s", record.Type, record.App)
+	}
+	// the self app is skipped, counting its own overload would apply to it again
+	becameOverloaded := (!parentOverloaded && parent.IsOverloaded()) || (app != parent && !overloaded && app.IsOverloaded())
+	if becameOverloaded && record.App != core.self.App() {
+		core.self.StrSum("overloads", 1, record.App)
+	}
+	core.tail.Publish(record)
+	return nil
+}
+
+func (core *CoreStatistic) TakeIntMetrics() *map[string]*map[string]MetricValue {
+	result := make(map[string]*map[string]MetricValue)
 	buff := core.apps
 	for appName, app := range buff {
 		x := app.TakeIntMetrics()
@@ -81,8 +210,8 @@ func (core *CoreStatistic) TakeIntMetrics() *map[string]*map[string]int {
 	return &result
 }
 
-func (core *CoreStatistic) TakeIntDayMetrics() *map[string]*map[string]int {
-	result := make(map[string]*map[string]int)
+func (core *CoreStatistic) TakeIntDayMetrics() *map[string]*map[string]MetricValue {
+	result := make(map[string]*map[string]MetricValue)
 	buff := core.apps
 	core.mutex.Lock()
 	core.apps = make(map[string]*AppStatistic)
@@ -96,8 +225,8 @@ func (core *CoreStatistic) TakeIntDayMetrics() *map[string]*map[string]int {
 	return &result
 }
 
-func (core *CoreStatistic) TakeStringMetrics() *map[string]*map[string]map[string]int {
-	result := make(map[string]*map[string]map[string]int)
+func (core *CoreStatistic) TakeStringMetrics() *map[string]*map[string]PatternValues {
+	result := make(map[string]*map[string]PatternValues)
 	buff := core.apps
 	for appName, app := range buff {
 		m := app.TakeStringMetrics()
@@ -108,6 +237,26 @@ func (core *CoreStatistic) TakeStringMetrics() *map[string]*map[string]map[strin
 	return &result
 }
 
+// Apps returns the apps collected now, the map is a copy
+func (core *CoreStatistic) Apps() map[string]*AppStatistic {
+	core.mutex.RLock()
+	defer core.mutex.RUnlock()
+	apps := make(map[string]*AppStatistic, len(core.apps))
+	for appName, app := range core.apps {
+		apps[appName] = app
+	}
+	return apps
+}
+
+func (core *CoreStatistic) Snapshot() map[string]AppSnapshot {
+	apps := core.Apps()
+	result := make(map[string]AppSnapshot, len(apps))
+	for appName, app := range apps {
+		result[appName] = app.Snapshot()
+	}
+	return result
+}
+
 func (core *CoreStatistic) GetDataToSave() map[string]map[string][]byte {
 	core.mutex.Lock()
 	defer core.mutex.Unlock()
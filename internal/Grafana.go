@@ -0,0 +1,308 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Grafana SimpleJSON / JSON API datasource served under /grafana/.
+// Targets are app:metric for int metrics, app:metric:pattern for one pattern
+// of a string metric and app:metric:* for all patterns of it
+
+const grafanaSearchDays = 7
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type grafanaFilter struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+type grafanaTarget struct {
+	Target string            `json:"target"`
+	RefId  string            `json:"refId"`
+	Type   string            `json:"type"`
+	Data   map[string]string `json:"data"`
+}
+
+type grafanaQueryRequest struct {
+	Range         grafanaRange    `json:"range"`
+	IntervalMs    int             `json:"intervalMs"`
+	MaxDataPoints int             `json:"maxDataPoints"`
+	Targets       []grafanaTarget `json:"targets"`
+	AdhocFilters  []grafanaFilter `json:"adhocFilters"`
+}
+
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type grafanaAnnotationRequest struct {
+	Range      grafanaRange `json:"range"`
+	Annotation struct {
+		Name   string `json:"name"`
+		Query  string `json:"query"`
+		Enable bool   `json:"enable"`
+	} `json:"annotation"`
+}
+
+type grafanaAnnotation struct {
+	Annotation interface{} `json:"annotation"`
+	Time       int64       `json:"time"`
+	Title      string      `json:"title"`
+	Text       string      `json:"text"`
+	Tags       []string    `json:"tags"`
+}
+
+type grafanaTagKey struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type grafanaTagValue struct {
+	Text string `json:"text"`
+}
+
+// Ad hoc filters tune how targets are queried, any other key filters by tag
+var grafanaTagValues = map[string][]string{
+	"agg":    {"sum", "avg", "min", "max", "count", "last"},
+	"by":     {"node"},
+	"source": {"raw", "hour", "day"},
+}
+
+func (server *HttpSever) grafanaHandler(w http.ResponseWriter, r *http.Request) {
+	if !server.authorized(r) {
+		writeJsonError(w, http.StatusForbidden, "bad key")
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, "/grafana") {
+	case "", "/":
+		w.WriteHeader(http.StatusOK)
+	case "/search":
+		server.grafanaSearch(w, r)
+	case "/query":
+		server.grafanaQuery(w, r)
+	case "/annotations":
+		server.grafanaAnnotations(w, r)
+	case "/tag-keys":
+		keys := make([]grafanaTagKey, 0, len(grafanaTagValues))
+		for _, key := range []string{"agg", "by", "source"} {
+			keys = append(keys, grafanaTagKey{Type: "string", Text: key})
+		}
+		writeJson(w, http.StatusOK, keys)
+	case "/tag-values":
+		var request struct {
+			Key string `json:"key"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		values := []grafanaTagValue{}
+		for _, value := range grafanaTagValues[request.Key] {
+			values = append(values, grafanaTagValue{Text: value})
+		}
+		writeJson(w, http.StatusOK, values)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Empty target lists apps, app lists its metrics and app:metric lists patterns of a string metric
+func (server *HttpSever) grafanaSearch(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Target string `json:"target"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&request)
+	from := time.Now().Add(-grafanaSearchDays * 24 * time.Hour)
+	parts := strings.SplitN(strings.TrimSpace(request.Target), ":", 3)
+
+	result := []string{}
+	switch {
+	case parts[0] == "" || parts[0] == "*":
+		apps, err := server.saver.ListApps()
+		if err != nil {
+			server.logger.Error("grafana search failed", "error", err)
+			writeJsonError(w, http.StatusInternalServerError, "search fail")
+			return
+		}
+		result = apps
+	case len(parts) == 1:
+		metrics, err := server.saver.ListMetrics(parts[0], from)
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		for _, name := range metrics.Int {
+			result = append(result, parts[0]+":"+name)
+		}
+		for _, name := range metrics.String {
+			result = append(result, parts[0]+":"+name+":*")
+		}
+	default:
+		patterns, err := server.saver.ListPatterns(parts[0], parts[1], from)
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		for _, pattern := range patterns {
+			result = append(result, parts[0]+":"+parts[1]+":"+pattern)
+		}
+	}
+	writeJson(w, http.StatusOK, result)
+}
+
+func (server *HttpSever) grafanaQuery(w http.ResponseWriter, r *http.Request) {
+	var request grafanaQueryRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "bad body")
+		return
+	}
+	step := request.IntervalMs / 1000
+	if step < 1 {
+		step = 1
+	}
+	if span := int(request.Range.To.Sub(request.Range.From).Seconds()); span/step > MaxSeriesPoints {
+		step = span/MaxSeriesPoints + 1
+	}
+	options := make(map[string]string)
+	for _, filter := range request.AdhocFilters {
+		if filter.Operator == "=" {
+			options[filter.Key] = filter.Value
+		}
+	}
+
+	result := []grafanaSeries{}
+	for _, target := range request.Targets {
+		if target.Target == "" {
+			continue
+		}
+		query, ok := grafanaSeriesQuery(target, options)
+		if !ok {
+			writeJsonError(w, http.StatusBadRequest, "bad target "+target.Target)
+			return
+		}
+		query.From = request.Range.From
+		query.To = request.Range.To
+		query.Step = step
+		series, err := server.saver.Series(query)
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, target.Target+": "+err.Error())
+			return
+		}
+		for _, s := range series {
+			name := target.Target
+			if s.Pattern != "" {
+				name = query.App + ":" + query.Metric + ":" + s.Pattern
+			} else if s.NodeId != nil {
+				name += " node " + intToString(*s.NodeId)
+			} else if len(s.Tags) > 0 {
+				name += " " + tagSetKey(s.Tags)
+			}
+			points := make([][2]float64, 0, len(s.Points))
+			for _, point := range s.Points {
+				points = append(points, [2]float64{point[1], point[0] * 1000})
+			}
+			result = append(result, grafanaSeries{Target: name, Datapoints: points})
+		}
+	}
+	writeJson(w, http.StatusOK, result)
+}
+
+func grafanaSeriesQuery(target grafanaTarget, options map[string]string) (SeriesQuery, bool) {
+	parts := strings.SplitN(target.Target, ":", 3)
+	if len(parts) < 2 {
+		return SeriesQuery{}, false
+	}
+	query := SeriesQuery{
+		App:    parts[0],
+		Metric: parts[1],
+		Agg:    options["agg"],
+		By:     options["by"],
+		Source: options["source"],
+	}
+	for key, value := range target.Data {
+		switch key {
+		case "agg":
+			query.Agg = value
+		case "by":
+			query.By = value
+		case "source":
+			query.Source = value
+		}
+	}
+	for key, value := range options {
+		if _, has := grafanaTagValues[key]; !has {
+			if query.Tags == nil {
+				query.Tags = make(map[string]string)
+			}
+			query.Tags[key] = value
+		}
+	}
+	if query.Source == "" {
+		query.Source = "raw"
+	}
+	if len(parts) == 3 {
+		if parts[2] == "*" {
+			query.By = "pattern"
+		} else {
+			query.Pattern = parts[2]
+		}
+	}
+	return query, true
+}
+
+// Every non zero bucket of a string metric becomes an annotation with the pattern as text,
+// so events like deploys logged as app:deploy:version show up on graphs
+func (server *HttpSever) grafanaAnnotations(w http.ResponseWriter, r *http.Request) {
+	var request grafanaAnnotationRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "bad body")
+		return
+	}
+	result := []grafanaAnnotation{}
+	parts := strings.SplitN(request.Annotation.Query, ":", 2)
+	if len(parts) != 2 {
+		writeJson(w, http.StatusOK, result)
+		return
+	}
+	step := 60
+	if span := int(request.Range.To.Sub(request.Range.From).Seconds()); span/step > MaxSeriesPoints {
+		step = span/MaxSeriesPoints + 1
+	}
+	series, err := server.saver.Series(SeriesQuery{
+		App:    parts[0],
+		Metric: parts[1],
+		From:   request.Range.From,
+		To:     request.Range.To,
+		Step:   step,
+		Agg:    "sum",
+		By:     "pattern",
+		Source: "raw",
+	})
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, s := range series {
+		for _, point := range s.Points {
+			if point[1] == 0 {
+				continue
+			}
+			result = append(result, grafanaAnnotation{
+				Annotation: request.Annotation,
+				Time:       int64(point[0]) * 1000,
+				Title:      parts[1],
+				Text:       s.Pattern,
+				Tags:       []string{parts[0]},
+			})
+		}
+	}
+	writeJson(w, http.StatusOK, result)
+}
@@ -2,7 +2,6 @@ package internal
 
 import (
 	"github.com/stels-cs/vk-api-tools"
-	"log"
 	"strconv"
 	"strings"
 )
@@ -17,10 +16,10 @@ type Group struct {
 type UserPoll struct {
 	poll   map[string]Group
 	api    *VkApi.Api
-	logger *log.Logger
+	logger *Logger
 }
 
-func GetUserPoll(api *VkApi.Api, logger *log.Logger) *UserPoll {
+func GetUserPoll(api *VkApi.Api, logger *Logger) *UserPoll {
 	return &UserPoll{map[string]Group{}, api, logger}
 }
 
@@ -31,9 +30,9 @@ func Get(groupIds []string) map[string]Group {
 	return cache.Get(groupIds)
 }
 
-func InitCache(logger *log.Logger, token string) {
+func InitCache(logger *Logger, token string) {
 	t := VkApi.GetHttpTransport()
-	cache = GetUserPoll(VkApi.CreateApi(token, "5.101", t, 2), logger)
+	cache = GetUserPoll(VkApi.CreateApi(token, "5.101", t, 2), logger.Named("GroupCache"))
 }
 
 func (up *UserPoll) Get(groupIds []string) map[string]Group {
@@ -79,7 +78,7 @@ func (up *UserPoll) req(toRequest []string) map[string]Group {
 			up.poll[intToString(v.Id)] = v
 		}
 	} else {
-		up.logger.Println(err)
+		up.logger.Error("groups request failed", "error", err)
 	}
 	return result
 }
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"net/http"
+	"time"
+)
+
+const ServiceStarting = "starting"
+const ServiceRunning = "running"
+const ServiceRestarting = "restarting"
+const ServiceStopped = "stopped"
+
+// HealthChecker is implemented by services that depend on something outside the process,
+// a non nil error makes the process not ready
+type HealthChecker interface {
+	CheckHealth() error
+}
+
+type ServiceStatus struct {
+	Name        string     `json:"name"`
+	State       string     `json:"state"`
+	Since       time.Time  `json:"since"`
+	Restarts    int        `json:"restarts"`
+	Errors      int        `json:"errors"`
+	Failures    int        `json:"failures"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// False once the service is stopping, it must not be started then
+func (sp *ServicePoll) setRunning(state *serviceState) bool {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	if state.stopping {
+		return false
+	}
+	if state.state != ServiceStarting {
+		state.restarts++
+	}
+	state.state = ServiceRunning
+	state.since = time.Now().UTC()
+	return true
+}
+
+// Returns the failures in a row, they start over after a clean return or a run of backoffReset
+func (sp *ServicePoll) setExited(state *serviceState, err error, started time.Time) int {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	if err != nil {
+		state.errors++
+		state.lastError = err.Error()
+		state.lastErrorAt = time.Now().UTC()
+		if time.Since(started) > backoffReset {
+			state.failures = 0
+		}
+		state.failures++
+	} else {
+		state.failures = 0
+	}
+	if state.stopping {
+		state.state = ServiceStopped
+	} else {
+		state.state = ServiceRestarting
+	}
+	state.since = time.Now().UTC()
+	return state.failures
+}
+
+// Statuses of all pushed services in the order they were pushed
+func (sp *ServicePoll) Statuses() []ServiceStatus {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	result := make([]ServiceStatus, len(sp.states))
+	for i, state := range sp.states {
+		status := ServiceStatus{
+			Name:      state.name,
+			State:     state.state,
+			Since:     state.since,
+			Restarts:  state.restarts,
+			Errors:    state.errors,
+			Failures:  state.failures,
+			LastError: state.lastError,
+		}
+		if !state.lastErrorAt.IsZero() {
+			at := state.lastErrorAt
+			status.LastErrorAt = &at
+		}
+		result[i] = status
+	}
+	return result
+}
+
+// Checks runs CheckHealth of every service that has one, "ok" or the error by service name
+func (sp *ServicePoll) Checks() map[string]string {
+	result := make(map[string]string)
+	for _, service := range sp.poll {
+		checker, ok := service.(HealthChecker)
+		if !ok {
+			continue
+		}
+		if err := checker.CheckHealth(); err != nil {
+			result[service.GetName()] = err.Error()
+		} else {
+			result[service.GetName()] = "ok"
+		}
+	}
+	return result
+}
+
+type healthReport struct {
+	Status   string            `json:"status"`
+	Services []ServiceStatus   `json:"services"`
+	Checks   map[string]string `json:"checks,omitempty"`
+}
+
+// GET /healthz, fails while a service keeps failing
+func (sp *ServicePoll) Healthz(w http.ResponseWriter, r *http.Request) {
+	report := healthReport{Status: "ok", Services: sp.Statuses()}
+	for _, status := range report.Services {
+		if status.State == ServiceRestarting {
+			report.Status = "fail"
+		}
+	}
+	writeHealth(w, report)
+}
+
+// GET /readyz, fails unless every service runs and every dependency check passes
+func (sp *ServicePoll) Readyz(w http.ResponseWriter, r *http.Request) {
+	report := healthReport{Status: "ok", Services: sp.Statuses(), Checks: sp.Checks()}
+	for _, status := range report.Services {
+		if status.State != ServiceRunning {
+			report.Status = "fail"
+		}
+	}
+	for _, check := range report.Checks {
+		if check != "ok" {
+			report.Status = "fail"
+		}
+	}
+	writeHealth(w, report)
+}
+
+func writeHealth(w http.ResponseWriter, report healthReport) {
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJson(w, status, report)
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Nodes silent for this long are dropped, they were most likely removed on purpose
+const HeartbeatForget = 7 * 24 * time.Hour
+
+type NodeStatus struct {
+	App      string    `json:"app"`
+	NodeId   int       `json:"node_id"`
+	LastSeen time.Time `json:"last_seen"`
+	Silent   bool      `json:"silent"`
+}
+
+// HeartbeatService remembers when every app node was last stored and alerts about nodes
+// that have been silent for longer than grace, and again when they are back
+type HeartbeatService struct {
+	logger   *Logger
+	grace    time.Duration
+	notifier *Notifier
+	nodes    map[string]*NodeStatus
+	mutex    sync.Mutex
+	stop     chan bool
+}
+
+func CreateHeartbeatService(logger *Logger, grace time.Duration, notifier *Notifier) *HeartbeatService {
+	return &HeartbeatService{
+		logger:   logger.Named("Heartbeat"),
+		grace:    grace,
+		notifier: notifier,
+		nodes:    make(map[string]*NodeStatus),
+		stop:     make(chan bool, 1),
+	}
+}
+
+func (heartbeat *HeartbeatService) Start() error {
+	timer := time.NewTicker(heartbeat.grace / 4)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			heartbeat.check(time.Now().UTC())
+		case <-heartbeat.stop:
+			return nil
+		}
+	}
+}
+
+func (heartbeat *HeartbeatService) Stop() error {
+	heartbeat.stop <- true
+	return nil
+}
+
+func (heartbeat *HeartbeatService) GetName() string {
+	return "Heartbeat"
+}
+
+func (heartbeat *HeartbeatService) SavedInt(data map[string]map[string]MetricValue, at time.Time) {
+	for appName := range data {
+		heartbeat.seen(appName)
+	}
+}
+
+func (heartbeat *HeartbeatService) SavedString(data map[string]map[string]PatternValues, at time.Time) {
+	for appName := range data {
+		heartbeat.seen(appName)
+	}
+}
+
+// Batch time is not used, remote_write may deliver old samples of a node that is long gone
+func (heartbeat *HeartbeatService) seen(appName string) {
+	if !isValidAppName(appName) {
+		return
+	}
+	parts := strings.Split(appName, "/")
+	nodeId, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return
+	}
+	now := time.Now().UTC()
+	heartbeat.mutex.Lock()
+	node, has := heartbeat.nodes[appName]
+	if !has {
+		node = &NodeStatus{App: parts[0], NodeId: nodeId}
+		heartbeat.nodes[appName] = node
+	}
+	back := *node
+	node.LastSeen = now
+	node.Silent = false
+	heartbeat.mutex.Unlock()
+	if back.Silent {
+		// listeners must not block the saver
+		go heartbeat.notify(back, AlertResolved, now)
+	}
+}
+
+func (heartbeat *HeartbeatService) check(now time.Time) {
+	var silent []NodeStatus
+	heartbeat.mutex.Lock()
+	for appName, node := range heartbeat.nodes {
+		quiet := now.Sub(node.LastSeen)
+		if quiet > HeartbeatForget {
+			delete(heartbeat.nodes, appName)
+		} else if quiet > heartbeat.grace && !node.Silent {
+			node.Silent = true
+			silent = append(silent, *node)
+		}
+	}
+	heartbeat.mutex.Unlock()
+	for _, node := range silent {
+		heartbeat.notify(node, AlertFiring, now)
+	}
+}
+
+func (heartbeat *HeartbeatService) notify(node NodeStatus, state string, now time.Time) {
+	message := fmt.Sprintf("%s node %d is silent since %s", node.App, node.NodeId, node.LastSeen.Format(time.RFC3339))
+	if state == AlertResolved {
+		message = fmt.Sprintf("%s node %d is back after %s", node.App, node.NodeId, now.Sub(node.LastSeen).Round(time.Second))
+	}
+	heartbeat.notifier.Notify(Alert{
+		Rule:    "heartbeat",
+		State:   state,
+		App:     node.App + "/" + strconv.Itoa(node.NodeId),
+		Value:   now.Sub(node.LastSeen).Seconds(),
+		Message: message,
+		At:      now,
+	})
+}
+
+// Nodes returns all known nodes, silent ones first
+func (heartbeat *HeartbeatService) Nodes() []NodeStatus {
+	heartbeat.mutex.Lock()
+	result := make([]NodeStatus, 0, len(heartbeat.nodes))
+	for _, node := range heartbeat.nodes {
+		result = append(result, *node)
+	}
+	heartbeat.mutex.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Silent != result[j].Silent {
+			return result[i].Silent
+		}
+		if result[i].App != result[j].App {
+			return result[i].App < result[j].App
+		}
+		return result[i].NodeId < result[j].NodeId
+	})
+	return result
+}
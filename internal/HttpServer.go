@@ -3,35 +3,101 @@ package internal
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
+	"sync"
 )
 
 const StringHeader = "X-String-Values"
 
+// Set by senders whose payload carries the metric kind next to every value
+const KindHeader = "X-Metric-Kinds"
+
 type HttpSever struct {
-	host   string
-	key    string
-	server *http.Server
-	logger *log.Logger
-	saver  *StatSaver
+	host          string
+	key           string
+	server        *http.Server
+	stop          bool
+	logger        *Logger
+	saver         *StatSaver
+	promAppLabel  string
+	promNodeLabel string
+	heartbeat     *HeartbeatService
+	health        *ServicePoll
+	self          *SelfStat
+	mutex         sync.RWMutex
 }
 
-func CreateHttpServer(host, key string, logger *log.Logger, saver *StatSaver) *HttpSever {
+func CreateHttpServer(host, key string, logger *Logger, saver *StatSaver) *HttpSever {
 	return &HttpSever{
-		host:   host,
-		key:    key,
-		logger: logger,
-		saver:  saver,
+		host:          host,
+		key:           key,
+		logger:        logger.Named("HttpServer"),
+		saver:         saver,
+		promAppLabel:  "job",
+		promNodeLabel: "instance",
 	}
 }
 
+// SetSelfStat makes remote_write count its packets, records and rejects
+func (server *HttpSever) SetSelfStat(self *SelfStat) {
+	server.self = self
+}
+
 func (server *HttpSever) Start() error {
 	var defaultServeMux http.ServeMux
 	defaultServeMux.HandleFunc("/", server.handler)
-	server.server = &http.Server{Addr: server.host, Handler: &defaultServeMux}
-	return server.server.ListenAndServe()
+	defaultServeMux.HandleFunc("/api/apps", server.apiApps)
+	defaultServeMux.HandleFunc("/api/metrics", server.apiMetrics)
+	defaultServeMux.HandleFunc("/api/series", server.apiSeries)
+	defaultServeMux.HandleFunc("/grafana", server.grafanaHandler)
+	defaultServeMux.HandleFunc("/grafana/", server.grafanaHandler)
+	defaultServeMux.HandleFunc("/api/v1/write", server.remoteWrite)
+	defaultServeMux.HandleFunc("/api/nodes", server.apiNodes)
+	if server.health != nil {
+		defaultServeMux.HandleFunc("/healthz", server.health.Healthz)
+		defaultServeMux.HandleFunc("/readyz", server.health.Readyz)
+	}
+	httpServer := &http.Server{Addr: server.host, Handler: &defaultServeMux}
+	server.mutex.Lock()
+	server.server = httpServer
+	stop := server.stop
+	server.mutex.Unlock()
+	if stop {
+		return nil
+	}
+	err := httpServer.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// ResetStop is called by ServicePoll before every Start
+func (server *HttpSever) ResetStop() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.stop = false
+}
+
+// The key and remote write labels change in place, a new address restarts the server
+func (server *HttpSever) Reload(config *Config) bool {
+	server.mutex.Lock()
+	server.key = config.Secret
+	server.promAppLabel = config.PromAppLabel
+	server.promNodeLabel = config.PromNodeLabel
+	server.mutex.Unlock()
+	if config.Http == "" || config.Http == server.host {
+		return false
+	}
+	server.host = config.Http
+	return true
+}
+
+func (server *HttpSever) secret() string {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+	return server.key
 }
 
 func (server *HttpSever) GetName() string {
@@ -39,28 +105,45 @@ func (server *HttpSever) GetName() string {
 }
 
 func (server *HttpSever) Stop() error {
-	return server.server.Close()
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.stop = true
+	if server.server != nil {
+		return server.server.Close()
+	}
+	return nil
 }
 
 func (server *HttpSever) handler(w http.ResponseWriter, r *http.Request) {
-	if strings.Contains(r.URL.Path, server.key) {
+	if strings.Contains(r.URL.Path, server.secret()) {
 		decoder := json.NewDecoder(r.Body)
-		if r.Header.Get("X-String-Values") != "" {
-			buff := make(map[string]map[string]map[string]int)
-			err := decoder.Decode(&buff)
+		withKinds := r.Header.Get(KindHeader) != ""
+		if r.Header.Get(StringHeader) != "" {
+			buff := make(map[string]map[string]PatternValues)
+			var err error
+			if withKinds {
+				err = decoder.Decode(&buff)
+			} else {
+				buff, err = decodeLegacyString(decoder)
+			}
 			if err != nil {
 				fmt.Fprintf(w, "Bad body")
-				server.logger.Println("Bad body: ", err)
+				server.logger.Warn("bad body", "error", err, "from", r.RemoteAddr)
 				return
 			}
 			fmt.Fprintf(w, "OK")
 			go server.saver.SaveString(buff)
 		} else {
-			buff := make(map[string]map[string]int)
-			err := decoder.Decode(&buff)
+			buff := make(map[string]map[string]MetricValue)
+			var err error
+			if withKinds {
+				err = decoder.Decode(&buff)
+			} else {
+				buff, err = decodeLegacyInt(decoder)
+			}
 			if err != nil {
 				fmt.Fprintf(w, "Bad body")
-				server.logger.Println("Bad body: ", err)
+				server.logger.Warn("bad body", "error", err, "from", r.RemoteAddr)
 				return
 			}
 			fmt.Fprintf(w, "OK")
@@ -70,3 +153,38 @@ func (server *HttpSever) handler(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "BAD KEY")
 	}
 }
+
+// Older proxies send bare values, their kind stays unknown
+func decodeLegacyInt(decoder *json.Decoder) (map[string]map[string]MetricValue, error) {
+	raw := make(map[string]map[string]float64)
+	err := decoder.Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]map[string]MetricValue, len(raw))
+	for appName, metrics := range raw {
+		buff := make(map[string]MetricValue, len(metrics))
+		for name, value := range metrics {
+			buff[name] = MetricValue{Value: value}
+		}
+		result[appName] = buff
+	}
+	return result, nil
+}
+
+func decodeLegacyString(decoder *json.Decoder) (map[string]map[string]PatternValues, error) {
+	raw := make(map[string]map[string]map[string]float64)
+	err := decoder.Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]map[string]PatternValues, len(raw))
+	for appName, metrics := range raw {
+		buff := make(map[string]PatternValues, len(metrics))
+		for name, values := range metrics {
+			buff[name] = PatternValues{Values: values}
+		}
+		result[appName] = buff
+	}
+	return result, nil
+}
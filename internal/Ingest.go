@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+)
+
+// Record is one parsed measurement in terms of the RL protocol, every ingest protocol produces them
+type Record struct {
+	App     string
+	Param   string
+	Type    string
+	Value   float64
+	Pattern string
+	Tags    map[string]string
+}
+
+// RecordError is a rejected record, Reason is a short stable name self-monitoring counts errors by
+type RecordError struct {
+	Reason  string
+	Message string
+}
+
+func (err *RecordError) Error() string {
+	return err.Message
+}
+
+func recordError(reason, format string, args ...interface{}) error {
+	return &RecordError{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// Reason of a rejected record, "other" for errors that are not RecordError
+func errorReason(err error) string {
+	if recordErr, ok := err.(*RecordError); ok {
+		return recordErr.Reason
+	}
+	return "other"
+}
+
+var errTooLarge = errors.New("body too large")
+
+// readLimited reads all of reader or fails with errTooLarge past limit bytes. The reader may be an
+// http.MaxBytesReader with the same limit, its error at the limit is reported the same way
+func readLimited(reader io.Reader, limit int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if int64(len(data)) > limit || (err != nil && int64(len(data)) == limit) {
+		return nil, errTooLarge
+	}
+	return data, err
+}
+
+var appNameReplacer = regexp.MustCompile("[^A-Za-z0-9_-]+")
+
+// Builds the AppName/node name StatSaver expects from identifiers of other protocols
+func ingestAppName(app, node string) string {
+	name := appNameReplacer.ReplaceAllString(app, "_")
+	if name == "" {
+		name = "unknown"
+	}
+	return name + "/" + strconv.Itoa(nodeIdFromString(node))
+}
+
+// Node ids are integers, anything else like host:port is hashed into one
+func nodeIdFromString(value string) int {
+	if value == "" {
+		return 0
+	}
+	if id, err := strconv.Atoi(value); err == nil && id >= 0 && id <= 0x7fffffff {
+		return id
+	}
+	return int(crc32.ChecksumIEEE([]byte(value)) & 0x7fffffff)
+}
+
+// Kind a pattern record gets for the operation of a plain one
+var stringTags = map[string]string{
+	SumTag: StrSumTag,
+	SetTag: StrSetTag,
+	MinTag: StrMinTag,
+	MaxTag: StrMaxTag,
+	AvgTag: StrAvgTag,
+}
@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Timestamps of both protocols are ignored: values are aggregated into the current interval
+// like everything else that reaches CoreStatistic
+
+type LineParser interface {
+	Parse(line string) ([]Record, error)
+}
+
+// GraphiteRule maps a dotted path onto app, node, metric and pattern.
+// Template segments are app, node, metric, pattern or empty to skip, the last one
+// may end with * to take all remaining segments. Filter is a dotted glob, empty matches all
+type GraphiteRule struct {
+	filter   []string
+	template []string
+	kind     string
+}
+
+type GraphiteParser struct {
+	rules []GraphiteRule
+}
+
+// CreateGraphiteParser reads rules separated by ; each is "[filter] template [kind]",
+// for example "stats.counters.* ..app.metric* P;app.node.metric* S". Kind defaults to Set
+func CreateGraphiteParser(rules string) (*GraphiteParser, error) {
+	parser := &GraphiteParser{}
+	for _, raw := range strings.Split(rules, ";") {
+		fields := strings.Fields(raw)
+		if len(fields) == 0 {
+			continue
+		}
+		rule := GraphiteRule{kind: SetTag}
+		if len(fields) > 1 && !strings.Contains(fields[len(fields)-1], ".") {
+			rule.kind = fields[len(fields)-1]
+			fields = fields[:len(fields)-1]
+		}
+		switch len(fields) {
+		case 1:
+			rule.template = strings.Split(fields[0], ".")
+		case 2:
+			rule.filter = strings.Split(fields[0], ".")
+			rule.template = strings.Split(fields[1], ".")
+		default:
+			return nil, fmt.Errorf("bad graphite rule: %s", raw)
+		}
+		if _, has := stringTags[rule.kind]; !has {
+			return nil, fmt.Errorf("bad graphite rule kind %s, expected one of P S M I A", rule.kind)
+		}
+		hasApp, hasMetric := false, false
+		for i, segment := range rule.template {
+			name := strings.TrimSuffix(segment, "*")
+			if name != segment && i != len(rule.template)-1 {
+				return nil, fmt.Errorf("bad graphite rule, only the last segment may end with *: %s", raw)
+			}
+			switch name {
+			case "app":
+				hasApp = true
+			case "metric":
+				hasMetric = true
+			case "node", "pattern", "":
+			default:
+				return nil, fmt.Errorf("bad graphite rule segment %s: %s", segment, raw)
+			}
+		}
+		if !hasApp || !hasMetric {
+			return nil, fmt.Errorf("bad graphite rule, app and metric are required: %s", raw)
+		}
+		parser.rules = append(parser.rules, rule)
+	}
+	if len(parser.rules) == 0 {
+		return nil, errors.New("no graphite rules")
+	}
+	return parser, nil
+}
+
+func (rule GraphiteRule) matches(path []string) bool {
+	if len(rule.filter) > len(path) {
+		return false
+	}
+	for i, segment := range rule.filter {
+		if segment != "*" && segment != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// path value [timestamp]
+func (parser *GraphiteParser) Parse(line string) ([]Record, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, fmt.Errorf("Bad graphite line: %s", line)
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("Bad graphite value: %s", line)
+	}
+	path := strings.Split(fields[0], ".")
+	for _, rule := range parser.rules {
+		if !rule.matches(path) {
+			continue
+		}
+		parts := make(map[string][]string)
+		for i, segment := range rule.template {
+			if i >= len(path) {
+				break
+			}
+			name := strings.TrimSuffix(segment, "*")
+			if name != segment {
+				parts[name] = append(parts[name], path[i:]...)
+			} else {
+				parts[name] = append(parts[name], path[i])
+			}
+		}
+		if len(parts["app"]) == 0 || len(parts["metric"]) == 0 {
+			continue
+		}
+		record := Record{
+			App:   ingestAppName(strings.Join(parts["app"], "_"), strings.Join(parts["node"], ".")),
+			Param: truncateString(strings.Join(parts["metric"], "."), 50),
+			Type:  rule.kind,
+			Value: value,
+		}
+		if len(parts["pattern"]) > 0 {
+			record.Type = stringTags[rule.kind]
+			record.Pattern = strings.Join(parts["pattern"], ".")
+		}
+		return []Record{record}, nil
+	}
+	return nil, fmt.Errorf("No graphite rule for: %s", fields[0])
+}
+
+// InfluxParser maps measurement,tags fields into records: AppTag and NodeTag give the app name,
+// without AppTag the measurement is the app and fields are metrics, otherwise metrics are
+// measurement_field (just measurement for field "value"). PatternTags are joined into the pattern
+type InfluxParser struct {
+	AppTag      string
+	NodeTag     string
+	PatternTags []string
+	Kind        string
+}
+
+func CreateInfluxParser(appTag, nodeTag string, patternTags []string, kind string) (*InfluxParser, error) {
+	if _, has := stringTags[kind]; !has {
+		return nil, fmt.Errorf("bad influx kind %s, expected one of P S M I A", kind)
+	}
+	return &InfluxParser{AppTag: appTag, NodeTag: nodeTag, PatternTags: patternTags, Kind: kind}, nil
+}
+
+// measurement[,tag=value...] field=value[,field=value...] [timestamp]
+func (parser *InfluxParser) Parse(line string) ([]Record, error) {
+	sections := splitUnescaped(line, ' ')
+	if len(sections) != 2 && len(sections) != 3 {
+		return nil, fmt.Errorf("Bad influx line: %s", line)
+	}
+	keys := splitUnescaped(sections[0], ',')
+	measurement := unescapeInflux(keys[0])
+	tags := make(map[string]string, len(keys)-1)
+	for _, pair := range keys[1:] {
+		kv := splitUnescaped(pair, '=')
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Bad influx tag: %s", line)
+		}
+		tags[unescapeInflux(kv[0])] = unescapeInflux(kv[1])
+	}
+
+	app, hasApp := tags[parser.AppTag]
+	if !hasApp {
+		app = measurement
+	}
+	appName := ingestAppName(app, tags[parser.NodeTag])
+
+	var patternParts []string
+	for _, tag := range parser.PatternTags {
+		if value, has := tags[tag]; has {
+			patternParts = append(patternParts, tag+"="+value)
+		}
+	}
+	sort.Strings(patternParts)
+	pattern := strings.Join(patternParts, ",")
+
+	var records []Record
+	for _, pair := range splitUnescaped(sections[1], ',') {
+		kv := splitUnescaped(pair, '=')
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Bad influx field: %s", line)
+		}
+		field := unescapeInflux(kv[0])
+		value, ok := influxValue(kv[1])
+		if !ok {
+			// strings and booleans have nothing to aggregate
+			continue
+		}
+		param := field
+		if hasApp {
+			param = measurement
+			if field != "value" {
+				param += "_" + field
+			}
+		}
+		record := Record{App: appName, Param: truncateString(param, 50), Type: parser.Kind, Value: value}
+		if pattern != "" {
+			record.Type = stringTags[parser.Kind]
+			record.Pattern = pattern
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func influxValue(raw string) (float64, bool) {
+	if strings.HasPrefix(raw, `"`) {
+		return 0, false
+	}
+	raw = strings.TrimSuffix(strings.TrimSuffix(raw, "i"), "u")
+	value, err := strconv.ParseFloat(raw, 64)
+	return value, err == nil
+}
+
+// Splits on sep outside of double quotes and not preceded by a backslash
+func splitUnescaped(value string, sep byte) []string {
+	var result []string
+	start := 0
+	quoted := false
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				result = append(result, value[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(result, value[start:])
+}
+
+func unescapeInflux(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
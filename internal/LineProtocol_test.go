@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCreateGraphiteParser(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{name: "template only", rules: "app.metric*"},
+		{name: "filter, template and kind", rules: "stats.counters.* ..app.metric* P;app.node.metric*"},
+		{name: "empty", rules: " ; ", wantErr: true},
+		{name: "no metric", rules: "app.node", wantErr: true},
+		{name: "no app", rules: "node.metric*", wantErr: true},
+		{name: "star not last", rules: "app*.metric", wantErr: true},
+		{name: "unknown segment", rules: "app.host.metric", wantErr: true},
+		{name: "unknown kind", rules: "app.metric X", wantErr: true},
+		{name: "too many fields", rules: "a.b app.metric app.metric P", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := CreateGraphiteParser(test.rules)
+			if (err != nil) != test.wantErr {
+				t.Errorf("error %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestGraphiteParse(t *testing.T) {
+	parser, err := CreateGraphiteParser("stats.counters.* ..app.metric* P;servers.* .app.node.pattern.metric M;app.node.metric*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		line    string
+		want    []Record
+		wantErr bool
+	}{
+		{
+			name: "filtered rule with kind",
+			line: "stats.counters.api.requests.ok 5 1700000000",
+			want: []Record{{App: "api/0", Param: "requests.ok", Type: SumTag, Value: 5}},
+		},
+		{
+			name: "pattern makes a string metric",
+			line: "servers.web.7.eu.cpu 0.5",
+			want: []Record{{App: "web/7", Param: "cpu", Type: StrMaxTag, Value: 0.5, Pattern: "eu"}},
+		},
+		{
+			name: "default kind and rest of the path",
+			line: "billing.3.queue.size 12",
+			want: []Record{{App: "billing/3", Param: "queue.size", Type: SetTag, Value: 12}},
+		},
+		{name: "no value", line: "billing.3.queue", wantErr: true},
+		{name: "bad value", line: "billing.3.queue x", wantErr: true},
+		{name: "no metric segment", line: "billing 1", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parser.Parse(test.line)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestInfluxParse(t *testing.T) {
+	tagged, err := CreateInfluxParser("app", "host", []string{"region", "method"}, SumTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := CreateInfluxParser("app", "host", nil, SetTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		parser  *InfluxParser
+		line    string
+		want    []Record
+		wantErr bool
+	}{
+		{
+			name:   "measurement is the app",
+			parser: plain,
+			line:   "cpu,host=5 user=1.5,system=2i 1700000000000000000",
+			want: []Record{
+				{App: "cpu/5", Param: "user", Type: SetTag, Value: 1.5},
+				{App: "cpu/5", Param: "system", Type: SetTag, Value: 2},
+			},
+		},
+		{
+			name:   "app tag and value field",
+			parser: plain,
+			line:   "requests,app=api value=3,errors=1u",
+			want: []Record{
+				{App: "api/0", Param: "requests", Type: SetTag, Value: 3},
+				{App: "api/0", Param: "requests_errors", Type: SetTag, Value: 1},
+			},
+		},
+		{
+			name:   "pattern tags are sorted",
+			parser: tagged,
+			line:   "http,app=api,region=eu,method=get,other=x count=4",
+			want:   []Record{{App: "api/0", Param: "http_count", Type: StrSumTag, Value: 4, Pattern: "method=get,region=eu"}},
+		},
+		{
+			name:   "escapes and skipped string and bool fields",
+			parser: plain,
+			line:   `my\ app,host=1 a\=b=1,msg="x y,z",ok=true`,
+			want:   []Record{{App: "my_app/1", Param: "a=b", Type: SetTag, Value: 1}},
+		},
+		{name: "no fields", parser: plain, line: "cpu", wantErr: true},
+		{name: "bad tag", parser: plain, line: "cpu,host user=1", wantErr: true},
+		{name: "bad field", parser: plain, line: "cpu user", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.parser.Parse(test.line)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
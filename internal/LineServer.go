@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+)
+
+// LineServer accepts newline separated text protocols like Graphite plaintext or
+// Influx line protocol over udp or tcp and feeds parsed records into CoreStatistic
+type LineServer struct {
+	name     string
+	network  string
+	host     string
+	core     *CoreStatistic
+	parser   LineParser
+	logger   *Logger
+	pc       net.PacketConn
+	listener net.Listener
+	conns    map[net.Conn]bool
+	mutex    sync.Mutex
+	stop     bool
+	self     *SelfStat
+}
+
+func CreateLineServer(name, network, host string, parser LineParser, core *CoreStatistic, logger *Logger) *LineServer {
+	server := &LineServer{
+		name:    name,
+		network: network,
+		host:    host,
+		core:    core,
+		parser:  parser,
+		conns:   make(map[net.Conn]bool),
+	}
+	server.logger = logger.Named(server.GetName())
+	return server
+}
+
+func (server *LineServer) SetSelfStat(self *SelfStat) {
+	server.self = self
+}
+
+// Name self-monitoring metrics are grouped by, like graphite_tcp
+func (server *LineServer) source() string {
+	return strings.ToLower(server.name + "_" + server.network)
+}
+
+func (server *LineServer) Start() error {
+	if server.network == "udp" {
+		return server.startUdp()
+	}
+	return server.startTcp()
+}
+
+func (server *LineServer) startUdp() error {
+	pc, err := net.ListenPacket("udp", server.host)
+	if err != nil {
+		return err
+	}
+	server.mutex.Lock()
+	server.pc = pc
+	stop := server.stop
+	server.mutex.Unlock()
+	if stop {
+		pc.Close()
+		return nil
+	}
+	server.logger.Info("listening", "address", server.host)
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if server.stopped() {
+			return nil
+		}
+		if err != nil {
+			server.logger.Error("read failed", "error", err)
+			continue
+		}
+		server.self.StrSum("packets", 1, server.source())
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			server.serveLine(line, addr)
+		}
+	}
+}
+
+func (server *LineServer) startTcp() error {
+	listener, err := net.Listen("tcp", server.host)
+	if err != nil {
+		return err
+	}
+	server.mutex.Lock()
+	server.listener = listener
+	stop := server.stop
+	server.mutex.Unlock()
+	if stop {
+		listener.Close()
+		return nil
+	}
+	server.logger.Info("listening", "address", server.host)
+	for {
+		conn, err := listener.Accept()
+		if server.stopped() {
+			return nil
+		}
+		if err != nil {
+			server.logger.Error("accept failed", "error", err)
+			continue
+		}
+		server.mutex.Lock()
+		server.conns[conn] = true
+		server.mutex.Unlock()
+		go server.serveConn(conn)
+	}
+}
+
+func (server *LineServer) serveConn(conn net.Conn) {
+	defer func() {
+		server.mutex.Lock()
+		delete(server.conns, conn)
+		server.mutex.Unlock()
+		conn.Close()
+	}()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		server.serveLine(scanner.Text(), conn.RemoteAddr())
+	}
+}
+
+func (server *LineServer) serveLine(line string, addr net.Addr) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+	records, err := server.parser.Parse(line)
+	if err != nil {
+		server.self.StrSum("rejected", 1, server.source()+" parse")
+		server.logger.Warn("line rejected", "reason", "parse", "error", err, "from", addr.String())
+		return
+	}
+	for _, record := range records {
+		err = server.core.Apply(record)
+		if err != nil {
+			server.self.Rejected(server.source(), err)
+			server.logger.Warn("record rejected", "reason", errorReason(err), "error", err, "from", addr.String())
+			continue
+		}
+		server.self.StrSum("records", 1, server.source())
+	}
+}
+
+// ResetStop is called by ServicePoll before every Start
+func (server *LineServer) ResetStop() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.stop = false
+}
+
+func (server *LineServer) stopped() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.stop
+}
+
+func (server *LineServer) Stop() error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.stop = true
+	if server.pc != nil {
+		return server.pc.Close()
+	}
+	if server.listener != nil {
+		err := server.listener.Close()
+		for conn := range server.conns {
+			conn.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func (server *LineServer) Reload(config *Config) bool {
+	var host string
+	switch server.source() {
+	case "graphite_udp":
+		host = config.GraphiteUdp
+	case "graphite_tcp":
+		host = config.GraphiteTcp
+	case "influx_udp":
+		host = config.InfluxUdp
+	case "influx_tcp":
+		host = config.InfluxTcp
+	}
+	if host == "" || host == server.host {
+		return false
+	}
+	server.host = host
+	return true
+}
+
+func (server *LineServer) GetName() string {
+	return server.name + " " + strings.ToUpper(server.network)
+}
@@ -0,0 +1,286 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// How long the same message is counted for rate limiting, and how many keys are kept before
+// the ones with an ended window are dropped
+const logRateWindow = time.Minute
+const logRateKeys = 1024
+
+// ParseLogLevel takes debug, info, warn or error
+func ParseLogLevel(value string) (int, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(value, name) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown level %s, expected debug, info, warn or error", value)
+}
+
+// Logger writes leveled messages with key value fields, as text lines or as json objects.
+// A message logged more than the rate times a minute by the same component is dropped until
+// the minute ends, then one line tells how many were suppressed
+type Logger struct {
+	out  *logOutput
+	name string
+}
+
+type logOutput struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	level  int
+	json   bool
+	rate   int
+	keys   map[string]*logKey
+}
+
+type logKey struct {
+	start      time.Time
+	count      int
+	suppressed int
+	level      int
+	name       string
+	msg        string
+}
+
+func CreateLogger(writer io.Writer) *Logger {
+	return &Logger{
+		out: &logOutput{
+			writer: writer,
+			level:  LevelInfo,
+			keys:   make(map[string]*logKey),
+		},
+	}
+}
+
+// Named shares the output and settings, its messages carry the component name
+func (logger *Logger) Named(name string) *Logger {
+	return &Logger{out: logger.out, name: name}
+}
+
+func (logger *Logger) SetLevel(level int) {
+	logger.out.mutex.Lock()
+	defer logger.out.mutex.Unlock()
+	logger.out.level = level
+}
+
+func (logger *Logger) SetJson(enabled bool) {
+	logger.out.mutex.Lock()
+	defer logger.out.mutex.Unlock()
+	logger.out.json = enabled
+}
+
+// SetRate sets how many times a minute the same message is written, 0 writes all of them.
+// A change reports what was suppressed so far and starts counting over
+func (logger *Logger) SetRate(rate int) {
+	out := logger.out
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+	if rate == out.rate {
+		return
+	}
+	now := time.Now()
+	for _, key := range out.keys {
+		out.summary(now, key)
+	}
+	out.rate = rate
+	out.keys = make(map[string]*logKey)
+}
+
+// Configure applies LOG_LEVEL, LOG_FORMAT and LOG_RATE, they were validated on load
+func (logger *Logger) Configure(config *Config) {
+	level, _ := ParseLogLevel(config.LogLevel)
+	logger.SetLevel(level)
+	logger.SetJson(config.LogFormat == "json")
+	logger.SetRate(config.LogRate)
+}
+
+func (logger *Logger) Debug(msg string, fields ...interface{}) {
+	logger.log(LevelDebug, msg, fields)
+}
+
+func (logger *Logger) Info(msg string, fields ...interface{}) {
+	logger.log(LevelInfo, msg, fields)
+}
+
+func (logger *Logger) Warn(msg string, fields ...interface{}) {
+	logger.log(LevelWarn, msg, fields)
+}
+
+func (logger *Logger) Error(msg string, fields ...interface{}) {
+	logger.log(LevelError, msg, fields)
+}
+
+// Fatal writes the message whatever the level and rate are and exits
+func (logger *Logger) Fatal(msg string, fields ...interface{}) {
+	out := logger.out
+	out.mutex.Lock()
+	out.write(time.Now(), LevelError, caller(2), logger.name, msg, fields)
+	out.mutex.Unlock()
+	os.Exit(1)
+}
+
+func (logger *Logger) log(level int, msg string, fields []interface{}) {
+	out := logger.out
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+	if level < out.level {
+		return
+	}
+	now := time.Now()
+	if out.rate > 0 && !out.allow(now, level, logger.name, msg) {
+		return
+	}
+	out.write(now, level, caller(3), logger.name, msg, fields)
+}
+
+// Counts the message against its key, the first suppressed one schedules the summary for
+// the end of the window. Called with the mutex held
+func (out *logOutput) allow(now time.Time, level int, name, msg string) bool {
+	id := name + "\x00" + msg
+	key := out.keys[id]
+	if key == nil || now.Sub(key.start) >= logRateWindow {
+		if key != nil {
+			out.summary(now, key)
+		}
+		if len(out.keys) >= logRateKeys {
+			out.prune(now)
+		}
+		key = &logKey{start: now, level: level, name: name, msg: msg}
+		out.keys[id] = key
+	}
+	key.count++
+	if key.count <= out.rate {
+		return true
+	}
+	if key.suppressed == 0 {
+		time.AfterFunc(key.start.Add(logRateWindow).Sub(now), func() {
+			out.mutex.Lock()
+			defer out.mutex.Unlock()
+			if out.keys[id] == key {
+				out.summary(time.Now(), key)
+				delete(out.keys, id)
+			}
+		})
+	}
+	key.suppressed++
+	return false
+}
+
+func (out *logOutput) summary(now time.Time, key *logKey) {
+	if key.suppressed == 0 {
+		return
+	}
+	out.write(now, key.level, "", key.name, fmt.Sprintf("%d similar messages suppressed", key.suppressed),
+		[]interface{}{"message", key.msg, "suppressed", key.suppressed})
+	key.suppressed = 0
+}
+
+func (out *logOutput) prune(now time.Time) {
+	for id, key := range out.keys {
+		if key.suppressed == 0 && now.Sub(key.start) >= logRateWindow {
+			delete(out.keys, id)
+		}
+	}
+}
+
+func (out *logOutput) write(now time.Time, level int, source, name, msg string, fields []interface{}) {
+	if len(fields)%2 != 0 {
+		fields = append(fields[:len(fields)-1:len(fields)-1], "extra", fields[len(fields)-1])
+	}
+	var line strings.Builder
+	if out.json {
+		line.WriteString(`{"time":`)
+		writeJsonValue(&line, now.UTC().Format(time.RFC3339Nano))
+		line.WriteString(`,"level":`)
+		writeJsonValue(&line, strings.ToLower(levelNames[level]))
+		if source != "" {
+			line.WriteString(`,"caller":`)
+			writeJsonValue(&line, source)
+		}
+		if name != "" {
+			line.WriteString(`,"component":`)
+			writeJsonValue(&line, name)
+		}
+		line.WriteString(`,"msg":`)
+		writeJsonValue(&line, msg)
+		for i := 0; i < len(fields); i += 2 {
+			line.WriteString(",")
+			writeJsonValue(&line, fmt.Sprint(fields[i]))
+			line.WriteString(":")
+			writeJsonValue(&line, fieldValue(fields[i+1]))
+		}
+		line.WriteString("}\n")
+	} else {
+		line.WriteString(now.UTC().Format("2006/01/02 15:04:05 "))
+		if source != "" {
+			line.WriteString(source + ": ")
+		}
+		line.WriteString(levelNames[level])
+		if name != "" {
+			line.WriteString(" [" + name + "]")
+		}
+		line.WriteString(" " + msg)
+		for i := 0; i < len(fields); i += 2 {
+			line.WriteString(fmt.Sprintf(" %s=%s", fields[i], textValue(fieldValue(fields[i+1]))))
+		}
+		line.WriteString("\n")
+	}
+	_, _ = io.WriteString(out.writer, line.String())
+}
+
+// file:line of the code that called the logger skip frames up
+func caller(skip int) string {
+	_, file, line, ok := runtime.Caller(skip)
+	if !ok {
+		return ""
+	}
+	return filepath.Base(file) + ":" + strconv.Itoa(line)
+}
+
+// Errors, durations and other Stringers are written as their text
+func fieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+func writeJsonValue(line *strings.Builder, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	line.Write(data)
+}
+
+func textValue(value interface{}) string {
+	text := fmt.Sprint(value)
+	if text == "" || strings.ContainsAny(text, " =\"\n\t") {
+		return strconv.Quote(text)
+	}
+	return text
+}
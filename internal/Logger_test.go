@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+type logCall struct {
+	after time.Duration
+	name  string
+	msg   string
+}
+
+func TestLoggerRateLimit(t *testing.T) {
+	tests := []struct {
+		name        string
+		rate        int
+		calls       []logCall
+		want        []bool
+		wantSummary []string
+	}{
+		{
+			name:  "same message over the rate",
+			rate:  2,
+			calls: []logCall{{0, "", "a"}, {time.Second, "", "a"}, {2 * time.Second, "", "a"}, {3 * time.Second, "", "a"}},
+			want:  []bool{true, true, false, false},
+		},
+		{
+			name:  "messages and components are counted apart",
+			rate:  1,
+			calls: []logCall{{0, "udp", "a"}, {0, "udp", "b"}, {0, "http", "a"}, {0, "udp", "a"}},
+			want:  []bool{true, true, true, false},
+		},
+		{
+			name:        "next window starts over and reports the suppressed",
+			rate:        1,
+			calls:       []logCall{{0, "udp", "a"}, {time.Second, "udp", "a"}, {2 * time.Second, "udp", "a"}, {logRateWindow, "udp", "a"}},
+			want:        []bool{true, false, false, true},
+			wantSummary: []string{"[udp] 2 similar messages suppressed message=a suppressed=2"},
+		},
+		{
+			name:  "window ends without suppressed messages",
+			rate:  1,
+			calls: []logCall{{0, "", "a"}, {logRateWindow, "", "a"}},
+			want:  []bool{true, true},
+		},
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := CreateLogger(&buf)
+			logger.SetRate(test.rate)
+			out := logger.out
+			for i, call := range test.calls {
+				out.mutex.Lock()
+				allowed := out.allow(start.Add(call.after), LevelWarn, call.name, call.msg)
+				out.mutex.Unlock()
+				if allowed != test.want[i] {
+					t.Errorf("call %d allowed %v, want %v", i, allowed, test.want[i])
+				}
+			}
+			output := buf.String()
+			for _, summary := range test.wantSummary {
+				if !strings.Contains(output, summary) {
+					t.Errorf("output %q has no %q", output, summary)
+				}
+			}
+			if len(test.wantSummary) == 0 && output != "" {
+				t.Errorf("unexpected output %q", output)
+			}
+		})
+	}
+}
+
+func TestLoggerSetRateReportsSuppressed(t *testing.T) {
+	tests := []struct {
+		name      string
+		rate      int
+		messages  int
+		wantLines int
+	}{
+		{name: "unlimited", rate: 0, messages: 5, wantLines: 5},
+		{name: "limited", rate: 2, messages: 5, wantLines: 3},
+		{name: "under the rate", rate: 10, messages: 5, wantLines: 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := CreateLogger(&buf)
+			logger.SetRate(test.rate)
+			for i := 0; i < test.messages; i++ {
+				logger.Named("udp").Warn("read failed", "attempt", i)
+			}
+			// a new rate writes the summary of what was suppressed so far
+			logger.SetRate(test.rate + 1)
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if len(lines) != test.wantLines {
+				t.Fatalf("got %d lines, want %d:\n%s", len(lines), test.wantLines, buf.String())
+			}
+			if test.wantLines < test.messages && !strings.Contains(lines[len(lines)-1], "similar messages suppressed") {
+				t.Errorf("last line %q is not a summary", lines[len(lines)-1])
+			}
+		})
+	}
+}
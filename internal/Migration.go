@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/pgxpool"
+	"strings"
+	"sync"
+)
+
+// Migration changes one metric table, {table} in Sql is replaced with the table name.
+// Tables are created with the version 0 layout and brought up to date by migrations,
+// so new and existing tables always go the same way
+type Migration struct {
+	Version int
+	Name    string
+	Sql     string
+}
+
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "metric_kind",
+		Sql:     `alter table {table} add column IF NOT EXISTS kind char(1);`,
+	},
+	{
+		Version: 2,
+		Name:    "float_value",
+		Sql:     `alter table {table} alter column value type double precision;`,
+	},
+	{
+		Version: 3,
+		Name:    "metric_tags",
+		Sql: `alter table {table} add column IF NOT EXISTS tags jsonb;
+create index IF NOT EXISTS {table}_tags_index on {table} using gin (tags);`,
+	},
+}
+
+func (migration Migration) SqlFor(table string) string {
+	return strings.ReplaceAll(migration.Sql, "{table}", table)
+}
+
+type PlannedMigration struct {
+	Table     string
+	Migration Migration
+}
+
+type Migrator struct {
+	connection *pgxpool.Pool
+	logger     *Logger
+	versions   map[string]int
+	mutex      sync.Mutex
+	metaReady  bool
+}
+
+func CreateMigrator(connection *pgxpool.Pool, logger *Logger) *Migrator {
+	return &Migrator{
+		connection: connection,
+		logger:     logger.Named("Migration"),
+		versions:   make(map[string]int),
+	}
+}
+
+func (m *Migrator) createMetaTable() error {
+	if m.metaReady {
+		return nil
+	}
+	_, err := m.connection.Exec(context.Background(), `create table IF NOT EXISTS schema_migrations
+(
+	table_name varchar(100) not null,
+	version integer not null,
+	name varchar(100) not null,
+	applied_at timestamp default now(),
+	primary key (table_name, version)
+);
+`)
+	if err == nil {
+		m.metaReady = true
+	}
+	return err
+}
+
+// Tables returns raw and rollup metric tables of all apps
+func (m *Migrator) Tables() ([]string, error) {
+	rows, err := m.connection.Query(context.Background(), `select table_name from information_schema.tables
+where table_schema = current_schema()
+and (table_name like 't\_%' or table_name like 't1h\_%' or table_name like 't1d\_%')
+order by table_name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+func (m *Migrator) version(table string) (int, error) {
+	if version, has := m.versions[table]; has {
+		return version, nil
+	}
+	version := 0
+	err := m.connection.QueryRow(context.Background(),
+		"select coalesce(max(version), 0) from schema_migrations where table_name = $1", table).Scan(&version)
+	return version, err
+}
+
+// Migrate applies pending migrations to table, with dryRun they are only returned
+func (m *Migrator) Migrate(table string, dryRun bool) ([]PlannedMigration, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	err := m.createMetaTable()
+	if err != nil {
+		return nil, err
+	}
+	version, err := m.version(table)
+	if err != nil {
+		return nil, err
+	}
+	var pending []PlannedMigration
+	for _, migration := range migrations {
+		if migration.Version > version {
+			pending = append(pending, PlannedMigration{Table: table, Migration: migration})
+		}
+	}
+	if dryRun {
+		return pending, nil
+	}
+	for _, planned := range pending {
+		err = m.apply(planned)
+		if err != nil {
+			return nil, fmt.Errorf("migration %d %s on %s: %s", planned.Migration.Version, planned.Migration.Name, table, err)
+		}
+		m.logger.Info("migration applied", "table", table, "version", planned.Migration.Version, "name", planned.Migration.Name)
+		version = planned.Migration.Version
+	}
+	m.versions[table] = version
+	return pending, nil
+}
+
+// MigrateAll brings every existing metric table to the latest version
+func (m *Migrator) MigrateAll(dryRun bool) ([]PlannedMigration, error) {
+	tables, err := m.Tables()
+	if err != nil {
+		return nil, err
+	}
+	var result []PlannedMigration
+	for _, table := range tables {
+		planned, err := m.Migrate(table, dryRun)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, planned...)
+	}
+	return result, nil
+}
+
+func (m *Migrator) apply(planned PlannedMigration) error {
+	ctx := context.Background()
+	tx, err := m.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, planned.Migration.SqlFor(planned.Table))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, "INSERT INTO schema_migrations(table_name,version,name) VALUES ($1,$2,$3)",
+		planned.Table, planned.Migration.Version, planned.Migration.Name)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
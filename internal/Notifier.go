@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const AlertFiring = "firing"
+const AlertResolved = "resolved"
+
+// Alert is what a webhook receives when something starts or stops being wrong
+type Alert struct {
+	Rule      string    `json:"rule"`
+	State     string    `json:"state"`
+	App       string    `json:"app"`
+	Metric    string    `json:"metric,omitempty"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Message   string    `json:"message"`
+	At        time.Time `json:"at"`
+}
+
+// How many alerts wait for the webhook before new ones are dropped
+const notifyQueueSize = 100
+
+// Notifier posts alerts as JSON to a webhook, without url they are only logged. Posting runs in
+// Start so a slow webhook does not hold the services that raise alerts
+type Notifier struct {
+	url    string
+	client *http.Client
+	logger *Logger
+	queue  chan Alert
+	stop   chan bool
+}
+
+func CreateNotifier(url string, logger *Logger) *Notifier {
+	return &Notifier{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: logger.Named("Notifier"),
+		queue:  make(chan Alert, notifyQueueSize),
+		stop:   make(chan bool, 1),
+	}
+}
+
+func (notifier *Notifier) Start() error {
+	for {
+		select {
+		case alert := <-notifier.queue:
+			notifier.send(alert)
+		case <-notifier.stop:
+			if len(notifier.queue) > 0 {
+				notifier.logger.Warn("alerts not sent on stop", "count", len(notifier.queue))
+			}
+			return nil
+		}
+	}
+}
+
+func (notifier *Notifier) GetName() string {
+	return "Notifier"
+}
+
+func (notifier *Notifier) Stop() error {
+	select {
+	case notifier.stop <- true:
+	default:
+	}
+	return nil
+}
+
+// Notify logs the alert and queues it for the webhook, it never blocks
+func (notifier *Notifier) Notify(alert Alert) {
+	notifier.logger.Info("alert", "rule", alert.Rule, "state", alert.State, "message", alert.Message)
+	if notifier.url == "" {
+		return
+	}
+	select {
+	case notifier.queue <- alert:
+	default:
+		notifier.logger.Error("alert queue is full, alert dropped", "rule", alert.Rule)
+	}
+}
+
+// send makes three attempts, a lost notification is logged and dropped
+func (notifier *Notifier) send(alert Alert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		notifier.logger.Error("alert marshal failed", "error", err)
+		return
+	}
+	for attempt := 1; attempt <= 3; attempt++ {
+		err = notifier.post(body)
+		if err == nil {
+			return
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	notifier.logger.Error("alert webhook failed", "rule", alert.Rule, "error", err)
+}
+
+func (notifier *Notifier) post(body []byte) error {
+	resp, err := notifier.client.Post(notifier.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,412 @@
+package internal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OTLP metrics decoded into a flat model, from ExportMetricsServiceRequest protobuf or its JSON mapping.
+// Only what can be aggregated is kept: gauges, sums and explicit bucket histograms
+
+const (
+	otlpGauge = iota
+	otlpSum
+	otlpHistogram
+)
+
+const (
+	otlpTemporalityUnspecified = 0
+	otlpTemporalityDelta       = 1
+	otlpTemporalityCumulative  = 2
+)
+
+type otlpPoint struct {
+	attributes map[string]string
+	value      float64
+	count      uint64
+	sum        float64
+	bounds     []float64
+	buckets    []uint64
+}
+
+type otlpMetric struct {
+	name        string
+	kind        int
+	temporality int
+	points      []otlpPoint
+}
+
+type otlpResource struct {
+	attributes map[string]string
+	metrics    []otlpMetric
+}
+
+// Records maps a resource onto the AppName/node convention: service.name is the app and
+// service.instance.id the node. Delta sums are summed, cumulative sums and gauges are set,
+// histograms become per bucket counts with le=bound patterns plus name_sum and name_count
+func (resource otlpResource) Records() []Record {
+	appName := ingestAppName(resource.attributes["service.name"], resource.attributes["service.instance.id"])
+	var records []Record
+	for _, metric := range resource.metrics {
+		name := truncateString(metric.name, 50)
+		kind := SetTag
+		if metric.kind != otlpGauge && metric.temporality == otlpTemporalityDelta {
+			kind = SumTag
+		}
+		for _, point := range metric.points {
+			pattern := otlpPattern(point.attributes)
+			if metric.kind != otlpHistogram {
+				records = append(records, patternRecord(appName, name, kind, point.value, pattern))
+				continue
+			}
+			prefix := pattern
+			if prefix != "" {
+				prefix += ","
+			}
+			for i, count := range point.buckets {
+				bound := "+Inf"
+				if i < len(point.bounds) {
+					bound = strconv.FormatFloat(point.bounds[i], 'g', -1, 64)
+				}
+				records = append(records, Record{App: appName, Param: name, Type: stringTags[kind], Value: float64(count), Pattern: prefix + "le=" + bound})
+			}
+			records = append(records,
+				patternRecord(appName, truncateString(metric.name+"_sum", 50), kind, point.sum, pattern),
+				patternRecord(appName, truncateString(metric.name+"_count", 50), kind, float64(point.count), pattern))
+		}
+	}
+	return records
+}
+
+func patternRecord(appName, name, kind string, value float64, pattern string) Record {
+	if pattern == "" {
+		return Record{App: appName, Param: name, Type: kind, Value: value}
+	}
+	return Record{App: appName, Param: name, Type: stringTags[kind], Value: value, Pattern: pattern}
+}
+
+func otlpPattern(attributes map[string]string) string {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, key+"="+attributes[key])
+	}
+	return strings.Join(parts, ",")
+}
+
+func decodeOtlpProto(buf []byte) ([]otlpResource, error) {
+	var result []otlpResource
+	err := protoFields(buf, func(num protowire.Number, data []byte, scalar uint64) error {
+		if num != 1 {
+			return nil
+		}
+		resource, err := decodeOtlpResourceMetrics(data)
+		if err == nil {
+			result = append(result, resource)
+		}
+		return err
+	})
+	return result, err
+}
+
+func decodeOtlpResourceMetrics(buf []byte) (otlpResource, error) {
+	resource := otlpResource{attributes: make(map[string]string)}
+	err := protoFields(buf, func(num protowire.Number, data []byte, scalar uint64) error {
+		switch num {
+		case 1:
+			return protoFields(data, func(num protowire.Number, data []byte, scalar uint64) error {
+				if num == 1 {
+					return decodeOtlpKeyValue(data, resource.attributes)
+				}
+				return nil
+			})
+		// scope_metrics, 1000 is instrumentation_library_metrics of older senders
+		case 2, 1000:
+			return protoFields(data, func(num protowire.Number, data []byte, scalar uint64) error {
+				if num != 2 {
+					return nil
+				}
+				metric, err := decodeOtlpMetric(data)
+				if err == nil && metric != nil {
+					resource.metrics = append(resource.metrics, *metric)
+				}
+				return err
+			})
+		}
+		return nil
+	})
+	return resource, err
+}
+
+func decodeOtlpKeyValue(buf []byte, attributes map[string]string) error {
+	key, value := "", ""
+	err := protoFields(buf, func(num protowire.Number, data []byte, scalar uint64) error {
+		if num == 1 {
+			key = string(data)
+		} else if num == 2 {
+			return protoFields(data, func(num protowire.Number, data []byte, scalar uint64) error {
+				switch num {
+				case 1:
+					value = string(data)
+				case 2:
+					value = strconv.FormatBool(scalar != 0)
+				case 3:
+					value = strconv.FormatInt(int64(scalar), 10)
+				case 4:
+					value = strconv.FormatFloat(math.Float64frombits(scalar), 'g', -1, 64)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	attributes[key] = value
+	return err
+}
+
+// Returns nil for metric types that are not supported
+func decodeOtlpMetric(buf []byte) (*otlpMetric, error) {
+	metric := otlpMetric{kind: -1}
+	err := protoFields(buf, func(num protowire.Number, data []byte, scalar uint64) error {
+		switch num {
+		case 1:
+			metric.name = string(data)
+		case 5:
+			metric.kind = otlpGauge
+			return decodeOtlpData(data, &metric)
+		case 7:
+			metric.kind = otlpSum
+			return decodeOtlpData(data, &metric)
+		case 9:
+			metric.kind = otlpHistogram
+			return decodeOtlpData(data, &metric)
+		}
+		return nil
+	})
+	if metric.kind == -1 || metric.name == "" {
+		return nil, err
+	}
+	return &metric, err
+}
+
+// Gauge, Sum and Histogram share data_points = 1 and aggregation_temporality = 2
+func decodeOtlpData(buf []byte, metric *otlpMetric) error {
+	return protoFields(buf, func(num protowire.Number, data []byte, scalar uint64) error {
+		switch num {
+		case 1:
+			var point otlpPoint
+			var err error
+			if metric.kind == otlpHistogram {
+				point, err = decodeOtlpHistogramPoint(data)
+			} else {
+				point, err = decodeOtlpNumberPoint(data)
+			}
+			if err == nil {
+				metric.points = append(metric.points, point)
+			}
+			return err
+		case 2:
+			metric.temporality = int(scalar)
+		}
+		return nil
+	})
+}
+
+func decodeOtlpNumberPoint(buf []byte) (otlpPoint, error) {
+	point := otlpPoint{attributes: make(map[string]string)}
+	err := protoFields(buf, func(num protowire.Number, data []byte, scalar uint64) error {
+		switch num {
+		case 4:
+			point.value = math.Float64frombits(scalar)
+		case 6:
+			point.value = float64(int64(scalar))
+		case 7:
+			return decodeOtlpKeyValue(data, point.attributes)
+		}
+		return nil
+	})
+	return point, err
+}
+
+func decodeOtlpHistogramPoint(buf []byte) (otlpPoint, error) {
+	point := otlpPoint{attributes: make(map[string]string)}
+	err := protoFields(buf, func(num protowire.Number, data []byte, scalar uint64) error {
+		switch num {
+		case 4:
+			point.count = scalar
+		case 5:
+			point.sum = math.Float64frombits(scalar)
+		case 6:
+			point.buckets = append(point.buckets, otlpFixed64(data, scalar)...)
+		case 7:
+			for _, bits := range otlpFixed64(data, scalar) {
+				point.bounds = append(point.bounds, math.Float64frombits(bits))
+			}
+		case 9:
+			return decodeOtlpKeyValue(data, point.attributes)
+		}
+		return nil
+	})
+	return point, err
+}
+
+// Repeated fixed64 fields come packed or one value per field
+func otlpFixed64(data []byte, scalar uint64) []uint64 {
+	if data == nil {
+		return []uint64{scalar}
+	}
+	result := make([]uint64, 0, len(data)/8)
+	for len(data) >= 8 {
+		result = append(result, binary.LittleEndian.Uint64(data))
+		data = data[8:]
+	}
+	return result
+}
+
+// JSON mapping of OTLP, 64 bit integers may come as strings or numbers
+
+type otlpJsonInt int64
+
+func (value *otlpJsonInt) UnmarshalJSON(data []byte) error {
+	raw := strings.Trim(string(data), `"`)
+	parsed, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return err
+	}
+	*value = otlpJsonInt(parsed)
+	return nil
+}
+
+type otlpJsonTemporality int
+
+func (value *otlpJsonTemporality) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "1", "AGGREGATION_TEMPORALITY_DELTA":
+		*value = otlpTemporalityDelta
+	case "2", "AGGREGATION_TEMPORALITY_CUMULATIVE":
+		*value = otlpTemporalityCumulative
+	default:
+		*value = otlpTemporalityUnspecified
+	}
+	return nil
+}
+
+type otlpJsonKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue *string      `json:"stringValue"`
+		BoolValue   *bool        `json:"boolValue"`
+		IntValue    *otlpJsonInt `json:"intValue"`
+		DoubleValue *float64     `json:"doubleValue"`
+	} `json:"value"`
+}
+
+type otlpJsonPoint struct {
+	Attributes     []otlpJsonKeyValue `json:"attributes"`
+	AsDouble       *float64           `json:"asDouble"`
+	AsInt          *otlpJsonInt       `json:"asInt"`
+	Count          otlpJsonInt        `json:"count"`
+	Sum            float64            `json:"sum"`
+	BucketCounts   []otlpJsonInt      `json:"bucketCounts"`
+	ExplicitBounds []float64          `json:"explicitBounds"`
+}
+
+type otlpJsonData struct {
+	DataPoints             []otlpJsonPoint     `json:"dataPoints"`
+	AggregationTemporality otlpJsonTemporality `json:"aggregationTemporality"`
+}
+
+type otlpJsonMetric struct {
+	Name      string        `json:"name"`
+	Gauge     *otlpJsonData `json:"gauge"`
+	Sum       *otlpJsonData `json:"sum"`
+	Histogram *otlpJsonData `json:"histogram"`
+}
+
+type otlpJsonRequest struct {
+	ResourceMetrics []struct {
+		Resource struct {
+			Attributes []otlpJsonKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []struct {
+			Metrics []otlpJsonMetric `json:"metrics"`
+		} `json:"scopeMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+func otlpJsonAttributes(list []otlpJsonKeyValue) map[string]string {
+	attributes := make(map[string]string, len(list))
+	for _, kv := range list {
+		switch {
+		case kv.Value.StringValue != nil:
+			attributes[kv.Key] = *kv.Value.StringValue
+		case kv.Value.BoolValue != nil:
+			attributes[kv.Key] = strconv.FormatBool(*kv.Value.BoolValue)
+		case kv.Value.IntValue != nil:
+			attributes[kv.Key] = strconv.FormatInt(int64(*kv.Value.IntValue), 10)
+		case kv.Value.DoubleValue != nil:
+			attributes[kv.Key] = strconv.FormatFloat(*kv.Value.DoubleValue, 'g', -1, 64)
+		default:
+			attributes[kv.Key] = ""
+		}
+	}
+	return attributes
+}
+
+func decodeOtlpJson(buf []byte) ([]otlpResource, error) {
+	var request otlpJsonRequest
+	err := json.Unmarshal(buf, &request)
+	if err != nil {
+		return nil, err
+	}
+	var result []otlpResource
+	for _, rm := range request.ResourceMetrics {
+		resource := otlpResource{attributes: otlpJsonAttributes(rm.Resource.Attributes)}
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				metric := otlpMetric{name: m.Name}
+				var data *otlpJsonData
+				switch {
+				case m.Gauge != nil:
+					metric.kind, data = otlpGauge, m.Gauge
+				case m.Sum != nil:
+					metric.kind, data = otlpSum, m.Sum
+				case m.Histogram != nil:
+					metric.kind, data = otlpHistogram, m.Histogram
+				default:
+					continue
+				}
+				metric.temporality = int(data.AggregationTemporality)
+				for _, p := range data.DataPoints {
+					point := otlpPoint{
+						attributes: otlpJsonAttributes(p.Attributes),
+						count:      uint64(p.Count),
+						sum:        p.Sum,
+						bounds:     p.ExplicitBounds,
+					}
+					if p.AsDouble != nil {
+						point.value = *p.AsDouble
+					} else if p.AsInt != nil {
+						point.value = float64(*p.AsInt)
+					}
+					for _, count := range p.BucketCounts {
+						point.buckets = append(point.buckets, uint64(count))
+					}
+					metric.points = append(metric.points, point)
+				}
+				resource.metrics = append(resource.metrics, metric)
+			}
+		}
+		result = append(result, resource)
+	}
+	return result, nil
+}
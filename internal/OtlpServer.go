@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Limits of a request body as sent and after gunzip
+const otlpMaxBody = 16 << 20
+const otlpMaxDecoded = 64 << 20
+
+// OtlpServer is an OTLP/HTTP metrics receiver, it accepts protobuf and JSON on /v1/metrics
+type OtlpServer struct {
+	host   string
+	core   *CoreStatistic
+	server *http.Server
+	stop   bool
+	mutex  sync.Mutex
+	logger *Logger
+	self   *SelfStat
+}
+
+func CreateOtlpServer(host string, core *CoreStatistic, logger *Logger) *OtlpServer {
+	return &OtlpServer{
+		host:   host,
+		core:   core,
+		logger: logger.Named("OtlpServer"),
+	}
+}
+
+func (server *OtlpServer) SetSelfStat(self *SelfStat) {
+	server.self = self
+}
+
+func (server *OtlpServer) Start() error {
+	var mux http.ServeMux
+	mux.HandleFunc("/v1/metrics", server.metrics)
+	httpServer := &http.Server{Addr: server.host, Handler: &mux}
+	server.mutex.Lock()
+	server.server = httpServer
+	stop := server.stop
+	server.mutex.Unlock()
+	if stop {
+		return nil
+	}
+	server.logger.Info("listening", "address", server.host)
+	err := httpServer.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// ResetStop is called by ServicePoll before every Start
+func (server *OtlpServer) ResetStop() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.stop = false
+}
+
+func (server *OtlpServer) Reload(config *Config) bool {
+	if config.OtlpHttp == "" || config.OtlpHttp == server.host {
+		return false
+	}
+	server.host = config.OtlpHttp
+	return true
+}
+
+func (server *OtlpServer) GetName() string {
+	return "OtlpServer"
+}
+
+func (server *OtlpServer) Stop() error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.stop = true
+	if server.server != nil {
+		return server.server.Close()
+	}
+	return nil
+}
+
+func (server *OtlpServer) metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	raw, err := readLimited(http.MaxBytesReader(w, r.Body, otlpMaxBody), otlpMaxBody)
+	if err == nil && r.Header.Get("Content-Encoding") == "gzip" {
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			http.Error(w, "bad gzip body", http.StatusBadRequest)
+			return
+		}
+		raw, err = readLimited(gz, otlpMaxDecoded)
+		gz.Close()
+	}
+	if err == errTooLarge {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "read body fail", http.StatusBadRequest)
+		return
+	}
+
+	isJson := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	var resources []otlpResource
+	if isJson {
+		resources, err = decodeOtlpJson(raw)
+	} else {
+		resources, err = decodeOtlpProto(raw)
+	}
+	server.self.StrSum("packets", 1, "otlp")
+	if err != nil {
+		server.self.StrSum("rejected", 1, "otlp body")
+		server.logger.Warn("bad body", "error", err, "from", r.RemoteAddr)
+		http.Error(w, "bad body", http.StatusBadRequest)
+		return
+	}
+	for _, resource := range resources {
+		for _, record := range resource.Records() {
+			err = server.core.Apply(record)
+			if err != nil {
+				server.self.Rejected("otlp", err)
+				server.logger.Warn("record rejected", "reason", errorReason(err), "error", err, "from", r.RemoteAddr)
+				continue
+			}
+			server.self.StrSum("records", 1, "otlp")
+		}
+	}
+
+	// empty ExportMetricsServiceResponse
+	if isJson {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	} else {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}
+}
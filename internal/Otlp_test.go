@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func otlpMessage(num protowire.Number, data []byte) []byte {
+	buf := protowire.AppendTag(nil, num, protowire.BytesType)
+	return protowire.AppendBytes(buf, data)
+}
+
+func otlpDouble(num protowire.Number, value float64) []byte {
+	buf := protowire.AppendTag(nil, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(buf, math.Float64bits(value))
+}
+
+func otlpKeyValue(num protowire.Number, key, value string) []byte {
+	return otlpMessage(num, append(otlpMessage(1, []byte(key)), otlpMessage(2, otlpMessage(1, []byte(value)))...))
+}
+
+func otlpConcat(parts ...[]byte) []byte {
+	var buf []byte
+	for _, part := range parts {
+		buf = append(buf, part...)
+	}
+	return buf
+}
+
+// One resource of service api, instance 3, with the metrics in a single scope under field scope
+func otlpRequest(scope protowire.Number, metrics ...[]byte) []byte {
+	resource := otlpMessage(1, otlpConcat(
+		otlpKeyValue(1, "service.name", "api"),
+		otlpKeyValue(1, "service.instance.id", "3"),
+	))
+	var scopeMetrics []byte
+	for _, metric := range metrics {
+		scopeMetrics = append(scopeMetrics, otlpMessage(2, metric)...)
+	}
+	return otlpMessage(1, append(resource, otlpMessage(scope, scopeMetrics)...))
+}
+
+func TestDecodeOtlpProto(t *testing.T) {
+	gauge := otlpConcat(otlpMessage(1, []byte("cpu")), otlpMessage(5, otlpMessage(1, otlpDouble(4, 0.5))))
+
+	intPoint := protowire.AppendTag(nil, 6, protowire.Fixed64Type)
+	intPoint = protowire.AppendFixed64(intPoint, 4)
+	deltaSum := otlpConcat(otlpMessage(1, []byte("requests")), otlpMessage(7, otlpConcat(
+		otlpMessage(1, append(intPoint, otlpKeyValue(7, "method", "get")...)),
+		protowire.AppendVarint(protowire.AppendTag(nil, 2, protowire.VarintType), otlpTemporalityDelta),
+	)))
+
+	count := protowire.AppendFixed64(protowire.AppendTag(nil, 4, protowire.Fixed64Type), 5)
+	buckets := protowire.AppendFixed64(protowire.AppendFixed64(nil, 2), 3)
+	bounds := protowire.AppendFixed64(nil, math.Float64bits(1))
+	histogram := otlpConcat(otlpMessage(1, []byte("latency")), otlpMessage(9, otlpConcat(
+		otlpMessage(1, otlpConcat(count, otlpDouble(5, 7), otlpMessage(6, buckets), otlpMessage(7, bounds))),
+		protowire.AppendVarint(protowire.AppendTag(nil, 2, protowire.VarintType), otlpTemporalityCumulative),
+	)))
+
+	summary := otlpConcat(otlpMessage(1, []byte("quantiles")), otlpMessage(11, otlpMessage(1, nil)))
+
+	tests := []struct {
+		name    string
+		buf     []byte
+		want    []Record
+		wantErr bool
+	}{
+		{
+			name: "gauge",
+			buf:  otlpRequest(2, gauge),
+			want: []Record{{App: "api/3", Param: "cpu", Type: SetTag, Value: 0.5}},
+		},
+		{
+			name: "delta sum with attributes",
+			buf:  otlpRequest(2, deltaSum),
+			want: []Record{{App: "api/3", Param: "requests", Type: StrSumTag, Value: 4, Pattern: "method=get"}},
+		},
+		{
+			name: "histogram",
+			buf:  otlpRequest(2, histogram),
+			want: []Record{
+				{App: "api/3", Param: "latency", Type: StrSetTag, Value: 2, Pattern: "le=1"},
+				{App: "api/3", Param: "latency", Type: StrSetTag, Value: 3, Pattern: "le=+Inf"},
+				{App: "api/3", Param: "latency_sum", Type: SetTag, Value: 7},
+				{App: "api/3", Param: "latency_count", Type: SetTag, Value: 5},
+			},
+		},
+		{
+			name: "older instrumentation library field",
+			buf:  otlpRequest(1000, gauge),
+			want: []Record{{App: "api/3", Param: "cpu", Type: SetTag, Value: 0.5}},
+		},
+		{
+			name: "unsupported type is skipped",
+			buf:  otlpRequest(2, summary, gauge),
+			want: []Record{{App: "api/3", Param: "cpu", Type: SetTag, Value: 0.5}},
+		},
+		{
+			name:    "truncated",
+			buf:     otlpRequest(2, gauge)[:10],
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resources, err := decodeOtlpProto(test.buf)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			var got []Record
+			for _, resource := range resources {
+				got = append(got, resource.Records()...)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeOtlpJson(t *testing.T) {
+	resource := `"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api"}},{"key":"service.instance.id","value":{"stringValue":"3"}}]}`
+	tests := []struct {
+		name    string
+		body    string
+		want    []Record
+		wantErr bool
+	}{
+		{
+			name: "gauge",
+			body: `{"resourceMetrics":[{` + resource + `,"scopeMetrics":[{"metrics":[
+				{"name":"cpu","gauge":{"dataPoints":[{"asDouble":0.5}]}}]}]}]}`,
+			want: []Record{{App: "api/3", Param: "cpu", Type: SetTag, Value: 0.5}},
+		},
+		{
+			name: "delta sum with string int and attributes",
+			body: `{"resourceMetrics":[{` + resource + `,"scopeMetrics":[{"metrics":[
+				{"name":"requests","sum":{"aggregationTemporality":"AGGREGATION_TEMPORALITY_DELTA","dataPoints":[
+					{"asInt":"4","attributes":[{"key":"ok","value":{"boolValue":true}}]}]}}]}]}]}`,
+			want: []Record{{App: "api/3", Param: "requests", Type: StrSumTag, Value: 4, Pattern: "ok=true"}},
+		},
+		{
+			name: "cumulative histogram",
+			body: `{"resourceMetrics":[{` + resource + `,"scopeMetrics":[{"metrics":[
+				{"name":"latency","histogram":{"aggregationTemporality":2,"dataPoints":[
+					{"count":"5","sum":7,"bucketCounts":["2",3],"explicitBounds":[1]}]}}]}]}]}`,
+			want: []Record{
+				{App: "api/3", Param: "latency", Type: StrSetTag, Value: 2, Pattern: "le=1"},
+				{App: "api/3", Param: "latency", Type: StrSetTag, Value: 3, Pattern: "le=+Inf"},
+				{App: "api/3", Param: "latency_sum", Type: SetTag, Value: 7},
+				{App: "api/3", Param: "latency_count", Type: SetTag, Value: 5},
+			},
+		},
+		{
+			name: "no service name",
+			body: `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"cpu","gauge":{"dataPoints":[{"asInt":1}]}}]}]}]}`,
+			want: []Record{{App: "unknown/0", Param: "cpu", Type: SetTag, Value: 1}},
+		},
+		{
+			name:    "bad int",
+			body:    `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"cpu","gauge":{"dataPoints":[{"asInt":"x"}]}}]}]}]}`,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resources, err := decodeOtlpJson([]byte(test.body))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %v", err, test.wantErr)
+			}
+			var got []Record
+			for _, resource := range resources {
+				got = append(got, resource.Records()...)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOtlpBodyLimits(t *testing.T) {
+	gzipped := func(size int) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, _ = gz.Write(make([]byte, size))
+		_ = gz.Close()
+		return buf.Bytes()
+	}
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		want     int
+	}{
+		{name: "empty body", body: nil, want: http.StatusOK},
+		{name: "body above the limit", body: make([]byte, otlpMaxBody+1), want: http.StatusRequestEntityTooLarge},
+		{name: "gzip above the decoded limit", body: gzipped(otlpMaxDecoded + 1), encoding: "gzip", want: http.StatusRequestEntityTooLarge},
+		{name: "bad gzip", body: []byte("plain"), encoding: "gzip", want: http.StatusBadRequest},
+	}
+	server := CreateOtlpServer("", CreateCoreStatistic(CreateLogger(ioutil.Discard)), CreateLogger(ioutil.Discard))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest("POST", "/v1/metrics", bytes.NewReader(test.body))
+			request.Header.Set("Content-Type", "application/x-protobuf")
+			if test.encoding != "" {
+				request.Header.Set("Content-Encoding", test.encoding)
+			}
+			recorder := httptest.NewRecorder()
+			server.metrics(recorder, request)
+			if recorder.Code != test.want {
+				t.Errorf("status %d, want %d", recorder.Code, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Values are exported as gauges: they hold what was collected since the last flush
+func WritePrometheus(w io.Writer, snapshot map[string]AppSnapshot) error {
+	families := make(map[string][]string)
+	add := func(metric, labels string, value MetricValue) {
+		metric, tags := splitTaggedName(metric)
+		name := prometheusName(metric)
+		labels += prometheusTagLabels(tags)
+		families[name] = append(families[name], name+"{"+labels+"} "+
+			strconv.FormatFloat(value.Value, 'g', -1, 64))
+	}
+	for appName, app := range snapshot {
+		labels := prometheusAppLabels(appName)
+		for metric, value := range app.Metrics {
+			add(metric, labels, value)
+		}
+		for metric, value := range app.Day {
+			add(metric, labels, value)
+		}
+		for metric, patterns := range app.Strings {
+			for pattern, value := range patterns.Values {
+				add(metric, labels+`,pattern="`+prometheusEscape(pattern)+`"`,
+					MetricValue{Kind: patterns.Kind, Value: value})
+			}
+		}
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buff := bufio.NewWriter(w)
+	for _, name := range names {
+		lines := families[name]
+		sort.Strings(lines)
+		buff.WriteString("# TYPE " + name + " gauge\n")
+		for _, line := range lines {
+			buff.WriteString(line)
+			buff.WriteByte('\n')
+		}
+	}
+	return buff.Flush()
+}
+
+func prometheusAppLabels(appName string) string {
+	parts := strings.SplitN(appName, "/", 2)
+	labels := `app="` + prometheusEscape(parts[0]) + `"`
+	if len(parts) == 2 {
+		labels += `,node_id="` + prometheusEscape(parts[1]) + `"`
+	}
+	return labels
+}
+
+// Tags become labels, in sorted order so lines of one series stay stable.
+// Tags named like our own labels get a tag_ prefix
+func prometheusTagLabels(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := ""
+	for _, key := range keys {
+		name := prometheusName(key)
+		if name == "app" || name == "node_id" || name == "pattern" {
+			name = "tag_" + name
+		}
+		labels += "," + name + `="` + prometheusEscape(tags[key]) + `"`
+	}
+	return labels
+}
+
+// Metric names may only contain [a-zA-Z0-9_:] and must not start with a digit
+func prometheusName(name string) string {
+	var b strings.Builder
+	for i, c := range name {
+		if c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9' && i > 0) {
+			b.WriteRune(c)
+		} else if c >= '0' && c <= '9' {
+			b.WriteString("_")
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+func prometheusEscape(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
@@ -0,0 +1,40 @@
+package internal
+
+import "google.golang.org/protobuf/encoding/protowire"
+
+// Calls fn for every field of an encoded protobuf message, length delimited fields come as data,
+// varint and fixed fields as scalar. Used instead of generated code for the few messages we accept
+func protoFields(buf []byte, fn func(num protowire.Number, data []byte, scalar uint64) error) error {
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		buf = buf[n:]
+		var data []byte
+		var scalar uint64
+		switch typ {
+		case protowire.VarintType:
+			scalar, n = protowire.ConsumeVarint(buf)
+		case protowire.Fixed64Type:
+			scalar, n = protowire.ConsumeFixed64(buf)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(buf)
+			scalar = uint64(v)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(buf)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, buf)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		buf = buf[n:]
+		err := fn(num, data, scalar)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,10 +3,11 @@ package internal
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -35,45 +36,49 @@ func SaveDatToFile(fileName string, data map[string]map[string][]byte) error {
 
 type ProxySender struct {
 	core        *CoreStatistic
-	logger      *log.Logger
+	logger      *Logger
 	url         string
 	file        string
-	stop        bool
 	timer       *time.Ticker
 	stopCh      chan bool
 	saveTimeSec int
+	self        *SelfStat
+	mutex       sync.Mutex
+	lastFlush   error
 }
 
-func CreateProxySender(core *CoreStatistic, url, file string, logger *log.Logger, saveTime int) *ProxySender {
+func CreateProxySender(core *CoreStatistic, url, file string, logger *Logger, saveTime int) *ProxySender {
 	return &ProxySender{
 		core:        core,
 		url:         url,
-		logger:      logger,
-		stop:        false,
+		logger:      logger.Named("ProxyServer"),
 		saveTimeSec: saveTime,
 		file:        file,
+		stopCh:      make(chan bool, 1),
 	}
 }
 
+func (proxy *ProxySender) SetSelfStat(self *SelfStat) {
+	proxy.self = self
+}
+
 func (proxy *ProxySender) Start() error {
-	proxy.stop = false
+	proxy.mutex.Lock()
 	proxy.timer = time.NewTicker(time.Duration(proxy.saveTimeSec) * time.Second)
-	proxy.stopCh = make(chan bool, 1)
+	proxy.mutex.Unlock()
 	tick := 0
 
 	data, err := ReadDataFromFile(proxy.file)
 	if err == nil {
 		proxy.core.RestoreData(data)
 	} else {
-		proxy.logger.Println("Fail read data", proxy.file, err)
+		proxy.logger.Warn("read saved data failed", "file", proxy.file, "error", err)
 	}
 	dayLog := false
 	for {
 		select {
 		case <-proxy.timer.C:
 		case <-proxy.stopCh:
-		}
-		if proxy.stop {
 			proxy.timer.Stop()
 			return nil
 		}
@@ -95,13 +100,32 @@ func (proxy *ProxySender) Start() error {
 	}
 }
 
+// The url and flush interval change in place
+func (proxy *ProxySender) Reload(config *Config) bool {
+	if config.ProxyTo == "" {
+		return false
+	}
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	proxy.url = config.ProxyTo
+	if config.SaveTime != proxy.saveTimeSec {
+		proxy.saveTimeSec = config.SaveTime
+		if proxy.timer != nil {
+			proxy.timer.Reset(time.Duration(config.SaveTime) * time.Second)
+		}
+	}
+	return false
+}
+
 func (proxy *ProxySender) GetName() string {
 	return "ProxyServer"
 }
 
 func (proxy *ProxySender) Stop() error {
-	proxy.stop = true
-	proxy.stopCh <- true
+	select {
+	case proxy.stopCh <- true:
+	default:
+	}
 	proxy.OnStop()
 	return nil
 }
@@ -113,9 +137,9 @@ func (proxy *ProxySender) OnStop() {
 	if len(save) > 0 {
 		err := SaveDatToFile(proxy.file, save)
 		if err == nil {
-			proxy.logger.Println("Data saved to file", proxy.file)
+			proxy.logger.Info("data saved to file", "file", proxy.file)
 		} else {
-			proxy.logger.Println("FAIL saving to file", proxy.file, err)
+			proxy.logger.Error("saving to file failed", "file", proxy.file, "error", err)
 		}
 	}
 }
@@ -125,27 +149,7 @@ func (proxy *ProxySender) sendInt() {
 	if data == nil || len(*data) <= 0 {
 		return
 	}
-	raw, err := json.Marshal(data)
-	if err != nil {
-		proxy.logger.Println("Fail marshal data: ", err)
-		return
-	}
-	tr := http.Client{Timeout: time.Second * 300}
-
-	resp, err := tr.Post(proxy.url, "application/json", bytes.NewReader(raw))
-	if err != nil {
-		proxy.logger.Println("Send data error: ", err)
-		return
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	defer resp.Body.Close()
-	if err != nil {
-		proxy.logger.Println("Read data error: ", err)
-		return
-	}
-	if string(body) != "OK" {
-		proxy.logger.Println("Bad response: ", string(body))
-	}
+	proxy.send(data, "int", time.Second*300)
 }
 
 func (proxy *ProxySender) sendDayInt() {
@@ -153,27 +157,7 @@ func (proxy *ProxySender) sendDayInt() {
 	if data == nil || len(*data) <= 0 {
 		return
 	}
-	raw, err := json.Marshal(data)
-	if err != nil {
-		proxy.logger.Println("Fail marshal data: ", err)
-		return
-	}
-	tr := http.Client{Timeout: time.Second * 300}
-
-	resp, err := tr.Post(proxy.url, "application/json", bytes.NewReader(raw))
-	defer resp.Body.Close()
-	if err != nil {
-		proxy.logger.Println("Send data error: ", err)
-		return
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		proxy.logger.Println("Read data error: ", err)
-		return
-	}
-	if string(body) != "OK" {
-		proxy.logger.Println("Bad response: ", string(body))
-	}
+	proxy.send(data, "day", time.Second*300)
 }
 
 func (proxy *ProxySender) sendString() {
@@ -181,33 +165,67 @@ func (proxy *ProxySender) sendString() {
 	if data == nil || len(*data) <= 0 {
 		return
 	}
+	proxy.send(data, "string", time.Second*600)
+}
+
+// kind is int, day or string, self-monitoring metrics of the flush are grouped by it
+func (proxy *ProxySender) send(data interface{}, kind string, timeout time.Duration) {
+	started := time.Now()
+	err := proxy.post(data, kind, timeout)
+	proxy.self.Duration("flush_ms", kind, started)
+	proxy.mutex.Lock()
+	proxy.lastFlush = err
+	proxy.mutex.Unlock()
+	if err != nil {
+		proxy.logger.Error("flush failed", "kind", kind, "error", err)
+	}
+}
+
+// CheckHealth returns the error of the last flush, nil before the first one
+func (proxy *ProxySender) CheckHealth() error {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	return proxy.lastFlush
+}
+
+func (proxy *ProxySender) post(data interface{}, kind string, timeout time.Duration) error {
 	raw, err := json.Marshal(data)
 	if err != nil {
-		proxy.logger.Println("Fail marshal data: ", err)
-		return
+		proxy.self.StrSum("send_errors", 1, kind+" marshal")
+		return fmt.Errorf("Fail marshal data: %s", err)
 	}
-	tr := http.Client{Timeout: time.Second * 600}
+	proxy.self.StrMax("payload_bytes", float64(len(raw)), kind)
+	tr := http.Client{Timeout: timeout}
 
-	req, err := http.NewRequest("POST", proxy.url, bytes.NewReader(raw))
+	proxy.mutex.Lock()
+	target := proxy.url
+	proxy.mutex.Unlock()
+	req, err := http.NewRequest("POST", target, bytes.NewReader(raw))
 	if err != nil {
-		proxy.logger.Println("Creating request error: ", err)
-		return
+		return fmt.Errorf("Creating request error: %s", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set(StringHeader, "1")
+	req.Header.Set(KindHeader, "1")
+	if kind == "string" {
+		req.Header.Set(StringHeader, "1")
+	}
 
+	sent := time.Now()
 	resp, err := tr.Do(req)
 	if err != nil {
-		proxy.logger.Println("Send data error: ", err)
-		return
+		proxy.self.StrSum("send_errors", 1, kind+" request")
+		return fmt.Errorf("Send data error: %s", err)
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
+	proxy.self.Duration("send_ms", kind, sent)
 	if err != nil {
-		proxy.logger.Println("Read data error: ", err)
-		return
+		proxy.self.StrSum("send_errors", 1, kind+" response")
+		return fmt.Errorf("Read data error: %s", err)
 	}
 	if string(body) != "OK" {
-		proxy.logger.Println("Bad response: ", string(body))
+		proxy.self.StrSum("send_errors", 1, kind+" response")
+		return fmt.Errorf("Bad response: %s", truncateString(string(body), 200))
 	}
+	return nil
 }
@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Read endpoints take the key from this header or from the key query parameter
+const KeyHeader = "X-Key"
+
+// Basic auth with the key as password is accepted too, datasources like Grafana can only send that
+func (server *HttpSever) authorized(r *http.Request) bool {
+	key := server.secret()
+	if _, password, ok := r.BasicAuth(); ok && password == key {
+		return true
+	}
+	return r.Header.Get(KeyHeader) == key || r.URL.Query().Get("key") == key
+}
+
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeJsonError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, map[string]string{"error": message})
+}
+
+// Accepts unix seconds or RFC3339
+func parseQueryTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func (server *HttpSever) apiApps(w http.ResponseWriter, r *http.Request) {
+	if !server.authorized(r) {
+		writeJsonError(w, http.StatusForbidden, "bad key")
+		return
+	}
+	apps, err := server.saver.ListApps()
+	if err != nil {
+		server.logger.Error("list apps failed", "error", err)
+		writeJsonError(w, http.StatusInternalServerError, "list apps fail")
+		return
+	}
+	writeJson(w, http.StatusOK, apps)
+}
+
+func (server *HttpSever) apiMetrics(w http.ResponseWriter, r *http.Request) {
+	if !server.authorized(r) {
+		writeJsonError(w, http.StatusForbidden, "bad key")
+		return
+	}
+	from, err := parseQueryTime(r.URL.Query().Get("from"), time.Now().Add(-24*time.Hour))
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "bad from")
+		return
+	}
+	metrics, err := server.saver.ListMetrics(r.URL.Query().Get("app"), from)
+	if err != nil {
+		server.logger.Error("list metrics failed", "error", err)
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJson(w, http.StatusOK, metrics)
+}
+
+// GET /api/series?app=&metric=[&pattern=][&tag=key:value...][&from=&to=][&step=60][&agg=][&by=node|pattern|tag:key][&source=raw|hour|day]
+func (server *HttpSever) apiSeries(w http.ResponseWriter, r *http.Request) {
+	if !server.authorized(r) {
+		writeJsonError(w, http.StatusForbidden, "bad key")
+		return
+	}
+	params := r.URL.Query()
+	now := time.Now()
+	to, err := parseQueryTime(params.Get("to"), now)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "bad to")
+		return
+	}
+	from, err := parseQueryTime(params.Get("from"), to.Add(-time.Hour))
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "bad from")
+		return
+	}
+	step := 60
+	if params.Get("step") != "" {
+		step, err = strconv.Atoi(params.Get("step"))
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, "bad step")
+			return
+		}
+	}
+	source := params.Get("source")
+	if source == "" {
+		source = "raw"
+	}
+	var tags map[string]string
+	for _, tag := range params["tag"] {
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) != 2 {
+			writeJsonError(w, http.StatusBadRequest, "bad tag, expected key:value")
+			return
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[kv[0]] = kv[1]
+	}
+	query := SeriesQuery{
+		App:     params.Get("app"),
+		Metric:  params.Get("metric"),
+		Pattern: params.Get("pattern"),
+		From:    from,
+		To:      to,
+		Step:    step,
+		Agg:     params.Get("agg"),
+		By:      params.Get("by"),
+		Source:  source,
+		Tags:    tags,
+	}
+	if query.Metric == "" {
+		writeJsonError(w, http.StatusBadRequest, "metric is required")
+		return
+	}
+	series, err := server.saver.Series(query)
+	if err != nil {
+		server.logger.Error("series failed", "error", err)
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"app":    query.App,
+		"metric": query.Metric,
+		"step":   query.Step,
+		"series": series,
+	})
+}
+
+// SetHealth serves /healthz and /readyz for the services of poll
+func (server *HttpSever) SetHealth(poll *ServicePoll) {
+	server.health = poll
+}
+
+func (server *HttpSever) SetHeartbeat(heartbeat *HeartbeatService) {
+	server.heartbeat = heartbeat
+}
+
+// GET /api/nodes[?silent=1] lists app nodes with the time they were last stored
+func (server *HttpSever) apiNodes(w http.ResponseWriter, r *http.Request) {
+	if !server.authorized(r) {
+		writeJsonError(w, http.StatusForbidden, "bad key")
+		return
+	}
+	if server.heartbeat == nil {
+		writeJsonError(w, http.StatusNotFound, "heartbeat is not enabled")
+		return
+	}
+	nodes := server.heartbeat.Nodes()
+	if r.URL.Query().Get("silent") != "" {
+		silent := make([]NodeStatus, 0)
+		for _, node := range nodes {
+			if node.Silent {
+				silent = append(silent, node)
+			}
+		}
+		nodes = silent
+	}
+	writeJson(w, http.StatusOK, nodes)
+}
@@ -0,0 +1,116 @@
+package internal
+
+import "reflect"
+
+// Reloadable services take new settings while running. Reload returns true when the service
+// has to be restarted to apply them, like a listener moving to another address
+type Reloadable interface {
+	Reload(config *Config) bool
+}
+
+// Settings the running process takes on reload, the rest need a restart
+var reloadableSettings = map[string]bool{
+	"LOG_LEVEL":       true,
+	"LOG_FORMAT":      true,
+	"LOG_RATE":        true,
+	"UDP":             true,
+	"GRAPHITE_UDP":    true,
+	"GRAPHITE_TCP":    true,
+	"INFLUX_UDP":      true,
+	"INFLUX_TCP":      true,
+	"OTLP_HTTP":       true,
+	"HTTP":            true,
+	"ADMIN_HTTP":      true,
+	"SECRET":          true,
+	"PROM_APP_LABEL":  true,
+	"PROM_NODE_LABEL": true,
+	"PROXY_TO":        true,
+	"SAVE_TIME":       true,
+	"MAX_METRICS":     true,
+	"APP_LIMITS":      true,
+	"UDP_ALLOW":       true,
+	"UDP_DENY":        true,
+	"UDP_APPS":        true,
+	"UDP_RATE":        true,
+}
+
+// Settings that turn a service on, changing them between empty and set adds or removes a
+// service which only a restart does
+var serviceSettings = map[string]bool{
+	"UDP":          true,
+	"GRAPHITE_UDP": true,
+	"GRAPHITE_TCP": true,
+	"INFLUX_UDP":   true,
+	"INFLUX_TCP":   true,
+	"OTLP_HTTP":    true,
+	"HTTP":         true,
+	"ADMIN_HTTP":   true,
+	"PROXY_TO":     true,
+}
+
+// Changed lists settings next has different from config
+func (config *Config) Changed(next *Config) []string {
+	var changed []string
+	current, updated := reflect.ValueOf(config).Elem(), reflect.ValueOf(next).Elem()
+	for _, field := range configFields() {
+		if current.Field(field.index).Interface() != updated.Field(field.index).Interface() {
+			changed = append(changed, field.name)
+		}
+	}
+	return changed
+}
+
+// NeedsRestart lists changed settings the running process can not take
+func (config *Config) NeedsRestart(next *Config) []string {
+	var result []string
+	current, updated := reflect.ValueOf(config).Elem(), reflect.ValueOf(next).Elem()
+	for _, field := range configFields() {
+		before, after := current.Field(field.index), updated.Field(field.index)
+		if before.Interface() == after.Interface() {
+			continue
+		}
+		if !reloadableSettings[field.name] || (serviceSettings[field.name] && (before.String() == "") != (after.String() == "")) {
+			result = append(result, field.name)
+		}
+	}
+	return result
+}
+
+// Applied is next with the settings that need a restart kept as config has them, it is what
+// the process runs with after a reload so the next one reports them again
+func (config *Config) Applied(next *Config) *Config {
+	applied := *next
+	current, result := reflect.ValueOf(config).Elem(), reflect.ValueOf(&applied).Elem()
+	restart := make(map[string]bool)
+	for _, name := range config.NeedsRestart(next) {
+		restart[name] = true
+	}
+	for _, field := range configFields() {
+		if restart[field.name] {
+			result.Field(field.index).Set(current.Field(field.index))
+		}
+	}
+	return &applied
+}
+
+// Reload hands config to every Reloadable service and restarts the ones that ask for it,
+// a stopped service is started again by its run loop. One that is not running now takes the
+// settings when it starts
+func (sp *ServicePoll) Reload(config *Config) {
+	for _, state := range sp.states {
+		reloadable, ok := state.service.(Reloadable)
+		if !ok || !reloadable.Reload(config) {
+			continue
+		}
+		sp.mutex.Lock()
+		running := state.state == ServiceRunning && !state.stopping
+		sp.mutex.Unlock()
+		if !running {
+			continue
+		}
+		state.logger.Info("restarting with new settings")
+		if err := state.service.Stop(); err != nil {
+			state.logger.Error("stop failed", "error", err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Limits of a remote_write request before and after snappy decoding
+const remoteWriteMaxBody = 16 << 20
+const remoteWriteMaxDecoded = 64 << 20
+
+// Prometheus remote_write: snappy compressed prometheus.WriteRequest.
+// The app label becomes AppName, the node label the node id and all other labels
+// except __name__ are joined into a pattern, such series go to the string tables
+
+type promSample struct {
+	value     float64
+	timestamp int64
+}
+
+type promSeries struct {
+	labels  map[string]string
+	samples []promSample
+}
+
+func decodeWriteRequest(buf []byte) ([]promSeries, error) {
+	var result []promSeries
+	err := protoFields(buf, func(num protowire.Number, data []byte, scalar uint64) error {
+		if num != 1 {
+			return nil
+		}
+		series, err := decodeTimeSeries(data)
+		if err == nil {
+			result = append(result, series)
+		}
+		return err
+	})
+	return result, err
+}
+
+func decodeTimeSeries(buf []byte) (promSeries, error) {
+	series := promSeries{labels: make(map[string]string)}
+	err := protoFields(buf, func(num protowire.Number, data []byte, scalar uint64) error {
+		switch num {
+		case 1:
+			var name, value string
+			err := protoFields(data, func(num protowire.Number, data []byte, scalar uint64) error {
+				if num == 1 {
+					name = string(data)
+				} else if num == 2 {
+					value = string(data)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			series.labels[name] = value
+		case 2:
+			var sample promSample
+			err := protoFields(data, func(num protowire.Number, data []byte, scalar uint64) error {
+				if num == 1 {
+					sample.value = math.Float64frombits(scalar)
+				} else if num == 2 {
+					sample.timestamp = int64(scalar)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			series.samples = append(series.samples, sample)
+		}
+		return nil
+	})
+	return series, err
+}
+
+func (server *HttpSever) SetRemoteWriteLabels(appLabel, nodeLabel string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.promAppLabel = appLabel
+	server.promNodeLabel = nodeLabel
+}
+
+func (server *HttpSever) remoteWriteLabels() (string, string) {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+	return server.promAppLabel, server.promNodeLabel
+}
+
+func (server *HttpSever) remoteWrite(w http.ResponseWriter, r *http.Request) {
+	if !server.authorized(r) {
+		http.Error(w, "bad key", http.StatusForbidden)
+		return
+	}
+	server.self.StrSum("packets", 1, "remote_write")
+	compressed, err := readLimited(http.MaxBytesReader(w, r.Body, remoteWriteMaxBody), remoteWriteMaxBody)
+	if err == errTooLarge {
+		server.self.StrSum("rejected", 1, "remote_write too_large")
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "read body fail", http.StatusBadRequest)
+		return
+	}
+	size, err := snappy.DecodedLen(compressed)
+	if err == nil && size > remoteWriteMaxDecoded {
+		server.self.StrSum("rejected", 1, "remote_write too_large")
+		http.Error(w, "decoded body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	raw, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		server.self.StrSum("rejected", 1, "remote_write body")
+		server.logger.Warn("bad remote write body", "error", err, "from", r.RemoteAddr)
+		http.Error(w, "bad snappy body", http.StatusBadRequest)
+		return
+	}
+	series, err := decodeWriteRequest(raw)
+	if err != nil {
+		server.self.StrSum("rejected", 1, "remote_write body")
+		server.logger.Warn("bad remote write body", "error", err, "from", r.RemoteAddr)
+		http.Error(w, "bad protobuf body", http.StatusBadRequest)
+		return
+	}
+	appLabel, nodeLabel := server.remoteWriteLabels()
+	ints, strs, skipped := remoteWriteMetrics(series, appLabel, nodeLabel)
+	records := 0
+	for _, apps := range ints {
+		for _, metrics := range apps {
+			records += len(metrics)
+		}
+	}
+	for _, apps := range strs {
+		for _, metrics := range apps {
+			records += len(metrics)
+		}
+	}
+	server.self.StrSum("records", float64(records), "remote_write")
+	if skipped > 0 {
+		server.self.StrSum("rejected", float64(skipped), "remote_write no_app")
+		server.logger.Warn("remote write series skipped, no __name__ or app label", "skipped", skipped, "app_label", appLabel)
+	}
+	// Prometheus retries only on 5xx, so the samples are stored before the answer. A retry
+	// stores again the apps that were saved before the failure
+	var saveErr error
+	for at, data := range ints {
+		if err := server.saver.SaveIntAt(data, at); err != nil {
+			saveErr = err
+		}
+	}
+	for at, data := range strs {
+		if err := server.saver.SaveStringAt(data, at); err != nil {
+			saveErr = err
+		}
+	}
+	if saveErr != nil {
+		server.self.StrSum("rejected", float64(records), "remote_write save")
+		http.Error(w, "save failed", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Samples are grouped by their second, Prometheus values are cumulative so they are stored as Set
+func remoteWriteMetrics(series []promSeries, appLabel, nodeLabel string) (map[time.Time]map[string]map[string]MetricValue, map[time.Time]map[string]map[string]PatternValues, int) {
+	ints := make(map[time.Time]map[string]map[string]MetricValue)
+	strs := make(map[time.Time]map[string]map[string]PatternValues)
+	skipped := 0
+	for _, s := range series {
+		name := s.labels["__name__"]
+		app := s.labels[appLabel]
+		if name == "" || app == "" {
+			skipped++
+			continue
+		}
+		name = truncateString(name, 50)
+		appName := ingestAppName(app, s.labels[nodeLabel])
+
+		keys := make([]string, 0, len(s.labels))
+		for key := range s.labels {
+			if key != "__name__" && key != appLabel && key != nodeLabel {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		pattern := ""
+		for i, key := range keys {
+			if i > 0 {
+				pattern += ","
+			}
+			pattern += key + "=" + s.labels[key]
+		}
+
+		for _, sample := range s.samples {
+			// NaN marks a stale series
+			if math.IsNaN(sample.value) {
+				continue
+			}
+			at := time.Unix(0, sample.timestamp*int64(time.Millisecond)).UTC().Truncate(time.Second)
+			if pattern == "" {
+				if _, has := ints[at]; !has {
+					ints[at] = make(map[string]map[string]MetricValue)
+				}
+				if _, has := ints[at][appName]; !has {
+					ints[at][appName] = make(map[string]MetricValue)
+				}
+				ints[at][appName][name] = MetricValue{Kind: SetTag, Value: sample.value}
+			} else {
+				if _, has := strs[at]; !has {
+					strs[at] = make(map[string]map[string]PatternValues)
+				}
+				if _, has := strs[at][appName]; !has {
+					strs[at][appName] = make(map[string]PatternValues)
+				}
+				metric, has := strs[at][appName][name]
+				if !has {
+					metric = PatternValues{Kind: StrSetTag, Values: make(map[string]float64)}
+					strs[at][appName][name] = metric
+				}
+				metric.Values[pattern] = sample.value
+			}
+		}
+	}
+	return ints, strs, skipped
+}
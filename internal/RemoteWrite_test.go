@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func promLabel(name, value string) []byte {
+	var buf []byte
+	buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+	buf = protowire.AppendString(buf, name)
+	buf = protowire.AppendTag(buf, 2, protowire.BytesType)
+	buf = protowire.AppendString(buf, value)
+	return buf
+}
+
+func promSampleBytes(value float64, timestamp int64) []byte {
+	var buf []byte
+	buf = protowire.AppendTag(buf, 1, protowire.Fixed64Type)
+	buf = protowire.AppendFixed64(buf, math.Float64bits(value))
+	buf = protowire.AppendTag(buf, 2, protowire.VarintType)
+	buf = protowire.AppendVarint(buf, uint64(timestamp))
+	return buf
+}
+
+// labels go as name, value pairs
+func promWriteRequest(labels []string, samples ...promSample) []byte {
+	var series []byte
+	for i := 0; i+1 < len(labels); i += 2 {
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, promLabel(labels[i], labels[i+1]))
+	}
+	for _, sample := range samples {
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, promSampleBytes(sample.value, sample.timestamp))
+	}
+	var buf []byte
+	buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+	return protowire.AppendBytes(buf, series)
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	// metadata is field 3 of WriteRequest, the decoder skips it
+	metadata := protowire.AppendTag(nil, 3, protowire.BytesType)
+	metadata = protowire.AppendBytes(metadata, []byte("skipped"))
+
+	tests := []struct {
+		name    string
+		buf     []byte
+		want    []promSeries
+		wantErr bool
+	}{
+		{name: "empty", buf: nil},
+		{
+			name: "labels and samples",
+			buf:  promWriteRequest([]string{"__name__", "requests", "job", "api"}, promSample{1.5, 1000}, promSample{2, 2000}),
+			want: []promSeries{{
+				labels:  map[string]string{"__name__": "requests", "job": "api"},
+				samples: []promSample{{1.5, 1000}, {2, 2000}},
+			}},
+		},
+		{
+			name: "two series and unknown field",
+			buf: append(append(promWriteRequest([]string{"__name__", "a"}, promSample{1, 10}), metadata...),
+				promWriteRequest([]string{"__name__", "b"})...),
+			want: []promSeries{
+				{labels: map[string]string{"__name__": "a"}, samples: []promSample{{1, 10}}},
+				{labels: map[string]string{"__name__": "b"}},
+			},
+		},
+		{
+			name:    "truncated",
+			buf:     promWriteRequest([]string{"__name__", "requests"})[:5],
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeWriteRequest(test.buf)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRemoteWriteMetrics(t *testing.T) {
+	at := time.Unix(100, 0).UTC()
+	tests := []struct {
+		name        string
+		series      []promSeries
+		wantInts    map[time.Time]map[string]map[string]MetricValue
+		wantStrs    map[time.Time]map[string]map[string]PatternValues
+		wantSkipped int
+	}{
+		{
+			name: "plain series is a Set",
+			series: []promSeries{{
+				labels:  map[string]string{"__name__": "up", "job": "api", "instance": "7"},
+				samples: []promSample{{1, 100500}},
+			}},
+			wantInts: map[time.Time]map[string]map[string]MetricValue{
+				at: {"api/7": {"up": {Kind: SetTag, Value: 1}}},
+			},
+			wantStrs: map[time.Time]map[string]map[string]PatternValues{},
+		},
+		{
+			name: "other labels make a pattern",
+			series: []promSeries{{
+				labels:  map[string]string{"__name__": "http", "job": "api", "method": "get", "code": "200"},
+				samples: []promSample{{7, 100000}},
+			}},
+			wantInts: map[time.Time]map[string]map[string]MetricValue{},
+			wantStrs: map[time.Time]map[string]map[string]PatternValues{
+				at: {"api/0": {"http": {Kind: StrSetTag, Values: map[string]float64{"code=200,method=get": 7}}}},
+			},
+		},
+		{
+			name: "no name or app and stale samples",
+			series: []promSeries{
+				{labels: map[string]string{"job": "api"}, samples: []promSample{{1, 100000}}},
+				{labels: map[string]string{"__name__": "up"}, samples: []promSample{{1, 100000}}},
+				{labels: map[string]string{"__name__": "up", "job": "api"}, samples: []promSample{{math.NaN(), 100000}}},
+			},
+			wantInts:    map[time.Time]map[string]map[string]MetricValue{},
+			wantStrs:    map[time.Time]map[string]map[string]PatternValues{},
+			wantSkipped: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ints, strs, skipped := remoteWriteMetrics(test.series, "job", "instance")
+			if skipped != test.wantSkipped {
+				t.Errorf("skipped %d, want %d", skipped, test.wantSkipped)
+			}
+			if !reflect.DeepEqual(ints, test.wantInts) {
+				t.Errorf("ints %+v, want %+v", ints, test.wantInts)
+			}
+			if !reflect.DeepEqual(strs, test.wantStrs) {
+				t.Errorf("strs %+v, want %+v", strs, test.wantStrs)
+			}
+		})
+	}
+}
+
+func TestReadLimited(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		limit   int64
+		wantErr error
+	}{
+		{name: "below", body: "abc", limit: 4},
+		{name: "at limit", body: "abcd", limit: 4},
+		{name: "above", body: "abcde", limit: 4, wantErr: errTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readLimited(strings.NewReader(test.body), test.limit)
+			if err != test.wantErr {
+				t.Fatalf("error %v, want %v", err, test.wantErr)
+			}
+			if err == nil && string(got) != test.body {
+				t.Errorf("got %q, want %q", got, test.body)
+			}
+			// the same through http.MaxBytesReader, which fails reading past its limit
+			request := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+			_, err = readLimited(http.MaxBytesReader(httptest.NewRecorder(), request.Body, test.limit), test.limit)
+			if err != test.wantErr {
+				t.Errorf("with MaxBytesReader error %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,433 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/pgxpool"
+	"strings"
+	"time"
+)
+
+const HourRollupPrefix = "t1h_"
+const DayRollupPrefix = "t1d_"
+
+type rollupResolution struct {
+	name   string
+	prefix string
+	step   time.Duration
+	chunk  time.Duration
+}
+
+var rollupResolutions = []rollupResolution{
+	{name: "hour", prefix: HourRollupPrefix, step: time.Hour, chunk: 24 * time.Hour},
+	{name: "day", prefix: DayRollupPrefix, step: 24 * time.Hour, chunk: 30 * 24 * time.Hour},
+}
+
+// Aggregate expression used to fold raw rows of a metric kind into one bucket. Avg of int
+// tables is weighted by its _sum and _count rows instead, see rollupChunk; string tables keep
+// no counts, so StrAvg buckets are the plain average of the stored averages
+var rollupAggregates = map[string]string{
+	SumTag:    "sum(value)",
+	SetTag:    "(array_agg(value order by created_at desc))[1]",
+	MaxTag:    "max(value)",
+	MinTag:    "min(value)",
+	AvgTag:    "avg(value)",
+	HllTag:    "max(value)",
+	HllDayTag: "max(value)",
+	StrSumTag: "sum(value)",
+	StrSetTag: "(array_agg(value order by created_at desc))[1]",
+	StrMinTag: "min(value)",
+	StrMaxTag: "max(value)",
+	StrAvgTag: "avg(value)",
+}
+
+func getRollupTableName(prefix, sourceTable string) string {
+	return prefix + strings.TrimPrefix(sourceTable, "t_")
+}
+
+// Rows written before kinds were stored have none, so guess it by name:
+// Avg writes name, name_sum and name_count, everything else uses defaultKind
+func inferKinds(stored map[string]string, defaultKind string) map[string]string {
+	kinds := make(map[string]string, len(stored))
+	for name, kind := range stored {
+		if kind != "" {
+			kinds[name] = kind
+		}
+	}
+	for name := range stored {
+		if _, has := kinds[name]; has {
+			continue
+		}
+		_, hasSum := stored[name+"_sum"]
+		_, hasCount := stored[name+"_count"]
+		if hasSum && hasCount {
+			kinds[name] = AvgTag
+			kinds[name+"_sum"] = SumTag
+			kinds[name+"_count"] = SumTag
+		} else {
+			kinds[name] = defaultKind
+		}
+	}
+	return kinds
+}
+
+// Groups metric names by the aggregate they are rolled up with. Averages of int tables that
+// have _sum and _count rows are returned apart, they are weighted by the counts
+func rollupPlan(stored map[string]string, defaultKind string, stringTable bool) (map[string][]string, []string) {
+	byKind := make(map[string][]string)
+	var weighted []string
+	for name, kind := range inferKinds(stored, defaultKind) {
+		if _, has := rollupAggregates[kind]; !has {
+			kind = defaultKind
+		}
+		_, hasSum := stored[name+"_sum"]
+		_, hasCount := stored[name+"_count"]
+		if kind == AvgTag && hasSum && hasCount && !stringTable {
+			weighted = append(weighted, name)
+			continue
+		}
+		byKind[kind] = append(byKind[kind], name)
+	}
+	return byKind, weighted
+}
+
+type RollupService struct {
+	logger         *Logger
+	databaseUrl    string
+	connection     *pgxpool.Pool
+	migrator       *Migrator
+	interval       time.Duration
+	delay          time.Duration
+	rawRetention   time.Duration
+	defaultKind    string
+	existingTables map[string]bool
+	stop           chan bool
+}
+
+// Rows may be stored up to delay after their time, like a flush or remote_write samples, so
+// buckets are rolled up only once that passed
+func CreateRollupService(logger *Logger, url string, interval, delay, rawRetention time.Duration, defaultKind string) *RollupService {
+	if _, has := rollupAggregates[defaultKind]; !has {
+		defaultKind = SumTag
+	}
+	return &RollupService{
+		logger:         logger.Named("Rollup"),
+		databaseUrl:    url,
+		interval:       interval,
+		delay:          delay,
+		rawRetention:   rawRetention,
+		defaultKind:    defaultKind,
+		existingTables: make(map[string]bool),
+		stop:           make(chan bool, 1),
+	}
+}
+
+func (rollup *RollupService) Start() error {
+	err := rollup.connect()
+	if err != nil {
+		return err
+	}
+	timer := time.NewTicker(rollup.interval)
+	defer timer.Stop()
+	for {
+		err = rollup.RollupAll()
+		if err != nil {
+			rollup.logger.Error("rollup failed", "error", err)
+		}
+		select {
+		case <-timer.C:
+		case <-rollup.stop:
+			rollup.connection.Close()
+			rollup.connection = nil
+			return nil
+		}
+	}
+}
+
+func (rollup *RollupService) Stop() error {
+	rollup.stop <- true
+	return nil
+}
+
+func (rollup *RollupService) GetName() string {
+	return "Rollup"
+}
+
+func (rollup *RollupService) connect() error {
+	if rollup.connection != nil {
+		return nil
+	}
+	conn, err := ConnectPostgres(rollup.databaseUrl)
+	if err != nil {
+		return err
+	}
+	// the connection is kept only once the progress table is there, so a failed start retries it
+	err = createProgressTable(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	rollup.connection = conn
+	rollup.migrator = CreateMigrator(conn, rollup.logger)
+	return nil
+}
+
+func createProgressTable(conn *pgxpool.Pool) error {
+	_, err := conn.Exec(context.Background(), `create table IF NOT EXISTS rollup_progress
+(
+	source varchar(100) not null,
+	resolution varchar(10) not null,
+	rolled_until timestamp not null,
+	updated_at timestamp default now(),
+	primary key (source, resolution)
+);
+`)
+	return err
+}
+
+// RollupAll brings every rollup table up to the last bucket that ended delay ago
+func (rollup *RollupService) RollupAll() error {
+	until := time.Now().UTC().Add(-rollup.delay).Truncate(time.Hour)
+	tables, err := rollup.sourceTables()
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		for _, res := range rollupResolutions {
+			from, err := rollup.progress(table, res)
+			if err != nil {
+				rollup.logger.Error("rollup progress failed", "table", table, "resolution", res.name, "error", err)
+				continue
+			}
+			if from.IsZero() {
+				continue
+			}
+			err = rollup.rollupTable(table, res, from, until.Truncate(res.step))
+			if err != nil {
+				rollup.logger.Error("rollup failed", "table", table, "resolution", res.name, "error", err)
+			}
+		}
+		if rollup.rawRetention > 0 {
+			err = rollup.dropRaw(table, until.Add(-rollup.rawRetention))
+			if err != nil {
+				rollup.logger.Error("drop raw rows failed", "table", table, "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+// RollupRange recalculates buckets between from and to, rows already rolled up in that range are replaced
+func (rollup *RollupService) RollupRange(from, to time.Time) error {
+	err := rollup.connect()
+	if err != nil {
+		return err
+	}
+	tables, err := rollup.sourceTables()
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		for _, res := range rollupResolutions {
+			err = rollup.rollupTable(table, res, from.UTC().Truncate(res.step), to.UTC().Truncate(res.step))
+			if err != nil {
+				return fmt.Errorf("%s %s: %s", table, res.name, err)
+			}
+			rollup.logger.Info("rolled up", "table", table, "resolution", res.name)
+		}
+	}
+	return nil
+}
+
+func (rollup *RollupService) sourceTables() ([]string, error) {
+	rows, err := rollup.connection.Query(context.Background(), `select table_name from information_schema.tables
+where table_schema = current_schema() and table_name like 't\_%'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+// Returns the time rollup should continue from, zero time when the source table is empty
+func (rollup *RollupService) progress(table string, res rollupResolution) (time.Time, error) {
+	var until *time.Time
+	err := rollup.connection.QueryRow(context.Background(),
+		"select max(rolled_until) from rollup_progress where source = $1 and resolution = $2",
+		table, res.name).Scan(&until)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if until != nil {
+		return *until, nil
+	}
+	err = rollup.connection.QueryRow(context.Background(), "select min(created_at) from "+table).Scan(&until)
+	if err != nil || until == nil {
+		return time.Time{}, err
+	}
+	return until.Truncate(res.step), nil
+}
+
+func (rollup *RollupService) rollupTable(table string, res rollupResolution, from, to time.Time) error {
+	target := getRollupTableName(res.prefix, table)
+	err := rollup.createRollupTable(target, isStringTable(table))
+	if err != nil {
+		return err
+	}
+	// source table may not have been written since the last migration
+	_, err = rollup.migrator.Migrate(table, false)
+	if err != nil {
+		return err
+	}
+	for start := from; start.Before(to); start = start.Add(res.chunk) {
+		end := start.Add(res.chunk)
+		if end.After(to) {
+			end = to
+		}
+		err = rollup.rollupChunk(table, target, res, start, end)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rollup *RollupService) rollupChunk(table, target string, res rollupResolution, from, to time.Time) error {
+	ctx := context.Background()
+	stored, err := rollup.metricKinds(table, from, to)
+	if err != nil {
+		return err
+	}
+	byKind, weighted := rollupPlan(stored, rollup.defaultKind, isStringTable(table))
+
+	columns := "type,value,node_id,tags"
+	selectColumns := "type,%s,node_id,tags"
+	if isStringTable(table) {
+		columns = "type,pattern,value,node_id,tags"
+		selectColumns = "type,pattern,%s,node_id,tags"
+	}
+
+	tx, err := rollup.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, "DELETE FROM "+target+" WHERE created_at >= $1 AND created_at < $2", from, to)
+	if err != nil {
+		return err
+	}
+	for kind, names := range byKind {
+		sqlStr := "INSERT INTO " + target + "(created_at," + columns + ",kind) " +
+			"SELECT date_trunc('" + res.name + "', created_at)," + fmt.Sprintf(selectColumns, rollupAggregates[kind]) + ",$4" +
+			" FROM " + table + " WHERE created_at >= $1 AND created_at < $2 AND type = any($3)" +
+			" GROUP BY 1," + strings.ReplaceAll(columns, ",value", "")
+		_, err = tx.Exec(ctx, sqlStr, from, to, names, kind)
+		if err != nil {
+			rollup.logger.Error("bad sql", "sql", sqlStr)
+			return err
+		}
+	}
+	// averaging the stored averages would weigh a node with few values like one with many
+	for _, name := range weighted {
+		sqlStr := "INSERT INTO " + target + "(created_at,type,value,node_id,tags,kind) " +
+			"SELECT date_trunc('" + res.name + "', created_at),$3," +
+			"sum(value) FILTER (WHERE type = $4) / sum(value) FILTER (WHERE type = $5),node_id,tags,$6" +
+			" FROM " + table + " WHERE created_at >= $1 AND created_at < $2 AND type IN ($4,$5)" +
+			" GROUP BY 1,node_id,tags HAVING sum(value) FILTER (WHERE type = $5) > 0"
+		_, err = tx.Exec(ctx, sqlStr, from, to, name, name+"_sum", name+"_count", AvgTag)
+		if err != nil {
+			rollup.logger.Error("bad sql", "sql", sqlStr)
+			return err
+		}
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO rollup_progress(source,resolution,rolled_until) VALUES ($1,$2,$3)
+ON CONFLICT (source,resolution) DO UPDATE
+SET rolled_until = greatest(rollup_progress.rolled_until, excluded.rolled_until), updated_at = now()`,
+		table, res.name, to)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Returns metric names found in range with their stored kind, empty for legacy rows
+func (rollup *RollupService) metricKinds(table string, from, to time.Time) (map[string]string, error) {
+	rows, err := rollup.connection.Query(context.Background(),
+		"select type, max(kind) from "+table+" where created_at >= $1 and created_at < $2 group by type", from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	kinds := make(map[string]string)
+	for rows.Next() {
+		var name string
+		var kind *string
+		err = rows.Scan(&name, &kind)
+		if err != nil {
+			return nil, err
+		}
+		if kind != nil {
+			kinds[name] = *kind
+		} else {
+			kinds[name] = ""
+		}
+	}
+	return kinds, rows.Err()
+}
+
+func (rollup *RollupService) createRollupTable(name string, withPattern bool) error {
+	if _, has := rollup.existingTables[name]; has {
+		return nil
+	}
+	pattern := ""
+	if withPattern {
+		pattern = "pattern varchar(200) not null,"
+	}
+	_, err := rollup.connection.Exec(context.Background(), `create table IF NOT EXISTS `+name+`
+(
+	created_at timestamp not null,
+	type varchar(50) not null,
+	`+pattern+`
+	value bigint not null,
+	node_id integer not null
+);
+create index IF NOT EXISTS `+name+`_created_at_index on `+name+` (created_at desc);
+`)
+	if err != nil {
+		return err
+	}
+	_, err = rollup.migrator.Migrate(name, false)
+	if err == nil {
+		rollup.existingTables[name] = true
+	}
+	return err
+}
+
+// Raw rows are removed only after both hourly and daily rollups have passed them
+func (rollup *RollupService) dropRaw(table string, before time.Time) error {
+	var until *time.Time
+	err := rollup.connection.QueryRow(context.Background(),
+		"select min(rolled_until) from rollup_progress where source = $1", table).Scan(&until)
+	if err != nil || until == nil {
+		return err
+	}
+	if until.Before(before) {
+		before = *until
+	}
+	_, err = rollup.connection.Exec(context.Background(), "DELETE FROM "+table+" WHERE created_at < $1", before)
+	return err
+}
+
+func isStringTable(table string) bool {
+	return strings.HasPrefix(table, "t_str_")
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestInferKinds(t *testing.T) {
+	tests := []struct {
+		name        string
+		stored      map[string]string
+		defaultKind string
+		want        map[string]string
+	}{
+		{name: "empty", stored: map[string]string{}, defaultKind: SumTag, want: map[string]string{}},
+		{
+			name:        "stored kinds are kept",
+			stored:      map[string]string{"requests": SumTag, "cpu": MaxTag},
+			defaultKind: SetTag,
+			want:        map[string]string{"requests": SumTag, "cpu": MaxTag},
+		},
+		{
+			name:        "legacy rows get the default kind",
+			stored:      map[string]string{"requests": "", "cpu": MaxTag},
+			defaultKind: SetTag,
+			want:        map[string]string{"requests": SetTag, "cpu": MaxTag},
+		},
+		{
+			name:        "legacy average with its sum and count",
+			stored:      map[string]string{"latency": "", "latency_sum": "", "latency_count": "", "requests": ""},
+			defaultKind: SetTag,
+			want:        map[string]string{"latency": AvgTag, "latency_sum": SumTag, "latency_count": SumTag, "requests": SetTag},
+		},
+		{
+			name:        "sum without count is no average",
+			stored:      map[string]string{"latency": "", "latency_sum": ""},
+			defaultKind: SetTag,
+			want:        map[string]string{"latency": SetTag, "latency_sum": SetTag},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := inferKinds(test.stored, test.defaultKind)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRollupAggregates(t *testing.T) {
+	tests := []struct {
+		kind string
+		want string
+	}{
+		{kind: SumTag, want: "sum(value)"},
+		{kind: SetTag, want: "(array_agg(value order by created_at desc))[1]"},
+		{kind: MaxTag, want: "max(value)"},
+		{kind: MinTag, want: "min(value)"},
+		{kind: AvgTag, want: "avg(value)"},
+		{kind: HllTag, want: "max(value)"},
+		{kind: HllDayTag, want: "max(value)"},
+		{kind: StrSumTag, want: "sum(value)"},
+		{kind: StrSetTag, want: "(array_agg(value order by created_at desc))[1]"},
+		{kind: StrMinTag, want: "min(value)"},
+		{kind: StrMaxTag, want: "max(value)"},
+		{kind: StrAvgTag, want: "avg(value)"},
+	}
+	if len(rollupAggregates) != len(tests) {
+		t.Errorf("%d aggregates, want %d", len(rollupAggregates), len(tests))
+	}
+	for _, test := range tests {
+		t.Run(test.kind, func(t *testing.T) {
+			if got := rollupAggregates[test.kind]; got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRollupPlan(t *testing.T) {
+	tests := []struct {
+		name         string
+		stored       map[string]string
+		stringTable  bool
+		wantByKind   map[string][]string
+		wantWeighted []string
+	}{
+		{
+			name:       "grouped by kind",
+			stored:     map[string]string{"requests": SumTag, "errors": SumTag, "cpu": MaxTag},
+			wantByKind: map[string][]string{SumTag: {"errors", "requests"}, MaxTag: {"cpu"}},
+		},
+		{
+			name:         "average with sum and count is weighted",
+			stored:       map[string]string{"latency": AvgTag, "latency_sum": SumTag, "latency_count": SumTag},
+			wantByKind:   map[string][]string{SumTag: {"latency_count", "latency_sum"}},
+			wantWeighted: []string{"latency"},
+		},
+		{
+			name:         "legacy average is weighted",
+			stored:       map[string]string{"latency": "", "latency_sum": "", "latency_count": ""},
+			wantByKind:   map[string][]string{SumTag: {"latency_count", "latency_sum"}},
+			wantWeighted: []string{"latency"},
+		},
+		{
+			name:       "average without counts is plain",
+			stored:     map[string]string{"latency": AvgTag},
+			wantByKind: map[string][]string{AvgTag: {"latency"}},
+		},
+		{
+			name:        "string tables keep no counts",
+			stored:      map[string]string{"latency": StrAvgTag, "latency_sum": StrSumTag, "latency_count": StrSumTag},
+			stringTable: true,
+			wantByKind:  map[string][]string{StrAvgTag: {"latency"}, StrSumTag: {"latency_count", "latency_sum"}},
+		},
+		{
+			name:       "unknown kind falls back to the default",
+			stored:     map[string]string{"requests": "Q"},
+			wantByKind: map[string][]string{SetTag: {"requests"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			byKind, weighted := rollupPlan(test.stored, SetTag, test.stringTable)
+			for _, names := range byKind {
+				sort.Strings(names)
+			}
+			if !reflect.DeepEqual(byKind, test.wantByKind) {
+				t.Errorf("by kind %v, want %v", byKind, test.wantByKind)
+			}
+			if !reflect.DeepEqual(weighted, test.wantWeighted) {
+				t.Errorf("weighted %v, want %v", weighted, test.wantWeighted)
+			}
+		})
+	}
+}
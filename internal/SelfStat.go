@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// SelfStat feeds metrics of the proxy itself into CoreStatistic under its own app name,
+// so they are proxied, saved and exposed like any other app. A nil SelfStat does nothing
+type SelfStat struct {
+	core *CoreStatistic
+	app  string
+}
+
+func CreateSelfStat(core *CoreStatistic, app string) *SelfStat {
+	// the app is listed from the start even before anything is counted
+	core.GetApp(app)
+	return &SelfStat{core: core, app: app}
+}
+
+func (stat *SelfStat) App() string {
+	if stat == nil {
+		return ""
+	}
+	return stat.app
+}
+
+func (stat *SelfStat) Sum(name string, value float64) {
+	stat.apply(Record{Param: name, Type: SumTag, Value: value})
+}
+
+func (stat *SelfStat) Max(name string, value float64) {
+	stat.apply(Record{Param: name, Type: MaxTag, Value: value})
+}
+
+func (stat *SelfStat) StrSum(name string, value float64, pattern string) {
+	stat.apply(Record{Param: name, Type: StrSumTag, Value: value, Pattern: pattern})
+}
+
+func (stat *SelfStat) StrMax(name string, value float64, pattern string) {
+	stat.apply(Record{Param: name, Type: StrMaxTag, Value: value, Pattern: pattern})
+}
+
+// Duration averages milliseconds since started, by pattern when it is set
+func (stat *SelfStat) Duration(name, pattern string, started time.Time) {
+	record := Record{
+		Param:   name,
+		Type:    AvgTag,
+		Value:   float64(time.Since(started)) / float64(time.Millisecond),
+		Pattern: pattern,
+	}
+	if pattern != "" {
+		record.Type = StrAvgTag
+	}
+	stat.apply(record)
+}
+
+// Rejected counts a record that was not applied by the reason of err
+func (stat *SelfStat) Rejected(source string, err error) {
+	stat.StrSum("rejected", 1, source+" "+errorReason(err))
+}
+
+func (stat *SelfStat) apply(record Record) {
+	if stat == nil {
+		return
+	}
+	record.App = stat.app
+	_ = stat.core.Apply(record)
+}
+
+// SelfSaver stores the self app through StatSaver every SAVE_TIME on collectors without
+// PROXY_TO, where no ProxySender takes its metrics. String metrics go every fifth time like
+// ProxySender sends them
+type SelfSaver struct {
+	stat     *SelfStat
+	saver    *StatSaver
+	interval time.Duration
+	timer    *time.Ticker
+	stop     chan bool
+	mutex    sync.Mutex
+}
+
+func CreateSelfSaver(stat *SelfStat, saver *StatSaver, interval time.Duration) *SelfSaver {
+	return &SelfSaver{
+		stat:     stat,
+		saver:    saver,
+		interval: interval,
+		stop:     make(chan bool, 1),
+	}
+}
+
+func (selfSaver *SelfSaver) Start() error {
+	selfSaver.mutex.Lock()
+	selfSaver.timer = time.NewTicker(selfSaver.interval)
+	selfSaver.mutex.Unlock()
+	defer selfSaver.timer.Stop()
+	tick := 0
+	for {
+		select {
+		case <-selfSaver.timer.C:
+		case <-selfSaver.stop:
+			selfSaver.saveInt()
+			selfSaver.saveString()
+			return nil
+		}
+		selfSaver.saveInt()
+		tick++
+		if tick >= 5 {
+			tick = 0
+			selfSaver.saveString()
+		}
+	}
+}
+
+// SAVE_TIME changes in place
+func (selfSaver *SelfSaver) Reload(config *Config) bool {
+	selfSaver.mutex.Lock()
+	defer selfSaver.mutex.Unlock()
+	interval := time.Duration(config.SaveTime) * time.Second
+	if interval != selfSaver.interval {
+		selfSaver.interval = interval
+		if selfSaver.timer != nil {
+			selfSaver.timer.Reset(interval)
+		}
+	}
+	return false
+}
+
+func (selfSaver *SelfSaver) GetName() string {
+	return "SelfSaver"
+}
+
+func (selfSaver *SelfSaver) Stop() error {
+	select {
+	case selfSaver.stop <- true:
+	default:
+	}
+	return nil
+}
+
+func (selfSaver *SelfSaver) saveInt() {
+	app := selfSaver.stat.App()
+	metrics := *selfSaver.stat.core.GetApp(app).TakeIntMetrics()
+	if len(metrics) > 0 {
+		selfSaver.saver.SaveInt(map[string]map[string]MetricValue{app: metrics})
+	}
+}
+
+func (selfSaver *SelfSaver) saveString() {
+	app := selfSaver.stat.App()
+	metrics := *selfSaver.stat.core.GetApp(app).TakeStringMetrics()
+	if len(metrics) > 0 {
+		selfSaver.saver.SaveString(map[string]map[string]PatternValues{app: metrics})
+	}
+}
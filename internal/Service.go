@@ -1,98 +1,335 @@
 package internal
 
 import (
-	"fmt"
-	"log"
+	"math/rand"
+	"sync"
 	"time"
 )
 
+// Restart delays of a failing service grow from backoffMin to backoffMax, a service that
+// ran for backoffReset before failing starts over from backoffMin
+const backoffMin = 500 * time.Millisecond
+const backoffMax = time.Minute
+const backoffReset = time.Minute
+
+// How long a service waits for its dependencies to become ready before it starts anyway
+const dependencyTimeout = 30 * time.Second
+
 type Service interface {
 	Start() error
 	GetName() string
 	Stop() error
 }
 
+// StopResetter is implemented by services that remember a Stop in a flag, the supervisor
+// clears it before every start so a Stop that came while the service was not running can
+// not end the next run, and one that comes during the start is not lost
+type StopResetter interface {
+	ResetStop()
+}
+
+type serviceState struct {
+	service      Service
+	name         string
+	logger       *Logger
+	dependencies []*serviceState
+	stopTimeout  time.Duration
+	stop         chan bool
+	stopOnce     sync.Once
+	done         chan bool
+
+	// guarded by ServicePoll.mutex
+	stopping    bool
+	state       string
+	since       time.Time
+	restarts    int
+	errors      int
+	failures    int
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// ServicePoll supervises services: a failed one is restarted after a growing delay, services
+// start after the ones they depend on are ready and stop before them
 type ServicePoll struct {
-	logger   *log.Logger
-	poll     []Service
-	stop     chan bool
-	allStop  bool
-	stopWait int
+	logger          *Logger
+	poll            []Service
+	states          []*serviceState
+	index           map[Service]*serviceState
+	mutex           *sync.Mutex
+	stopTimeout     time.Duration
+	shutdownTimeout time.Duration
 }
 
-func GetServicePoll(logger *log.Logger) ServicePoll {
+func GetServicePoll(logger *Logger) ServicePoll {
 	return ServicePoll{
-		logger: logger,
-		poll:   []Service{},
+		logger:          logger,
+		poll:            []Service{},
+		index:           make(map[Service]*serviceState),
+		mutex:           &sync.Mutex{},
+		stopTimeout:     10 * time.Second,
+		shutdownTimeout: 30 * time.Second,
 	}
 }
 
 func (sp *ServicePoll) Push(service Service) {
+	state := &serviceState{
+		service: service,
+		name:    service.GetName(),
+		logger:  sp.logger.Named(service.GetName()),
+		state:   ServiceStarting,
+		stop:    make(chan bool),
+		done:    make(chan bool),
+	}
 	sp.poll = append(sp.poll, service)
+	sp.states = append(sp.states, state)
+	sp.index[service] = state
 }
 
 func (sp *ServicePoll) Count() int {
 	return len(sp.poll)
 }
 
-func (sp *ServicePoll) RunAll() {
-	sp.allStop = false
-	for _, v := range sp.poll {
-		sp.run(v)
+// DependsOn makes service start after dependency is ready and stop before it. Both are pushed
+func (sp *ServicePoll) DependsOn(service, dependency Service) {
+	state, has := sp.index[service]
+	required, hasRequired := sp.index[dependency]
+	if !has || !hasRequired || state == required {
+		return
 	}
+	state.dependencies = append(state.dependencies, required)
 }
 
-func (sp *ServicePoll) StopAll() chan bool {
-	sp.allStop = true
-	sp.stopWait = 0
-	sp.stop = make(chan bool, 1)
-	for _, v := range sp.poll {
-		sp.stopWait++
-		sp.logger.Println(fmt.Sprintf("[%s] stopping...", v.GetName()))
-		err := v.Stop()
-		if err != nil {
-			sp.logger.Println(fmt.Sprintf("[%s] stopping error: %s", v.GetName(), err))
-		}
+// SetTimeouts sets how long each service may take to stop and how long all of them may take
+func (sp *ServicePoll) SetTimeouts(stop, shutdown time.Duration) {
+	sp.stopTimeout = stop
+	sp.shutdownTimeout = shutdown
+}
+
+// SetStopTimeout gives one service its own time to stop, like a sender doing the last flush
+func (sp *ServicePoll) SetStopTimeout(service Service, timeout time.Duration) {
+	if state, has := sp.index[service]; has {
+		state.stopTimeout = timeout
+	}
+}
+
+func (sp *ServicePoll) RunAll() {
+	for _, state := range sp.order() {
+		state.logger.Info("started")
+		go sp.run(state)
 	}
-	return sp.stop
 }
 
-func (sp *ServicePoll) run(service Service) {
-	sp.logger.Println(fmt.Sprintf("[%s] is started", service.GetName()))
-	errorCount := 0
-	lastEventTime := time.Now()
+// StopAll stops services in reverse dependency order. Each one has its stop timeout to return
+// from Start and all of them the shutdown timeout, the channel gets false when one was left running
+func (sp *ServicePoll) StopAll() chan bool {
+	result := make(chan bool, 1)
+	order := sp.order()
+	sp.mutex.Lock()
+	for _, state := range order {
+		state.stopping = true
+	}
+	sp.mutex.Unlock()
 	go func() {
-		for {
-			err := service.Start()
-			if sp.allStop {
-				if err != nil {
-					sp.logger.Println(fmt.Sprintf("[%s] %s", service.GetName(), err.Error()))
-				}
-				sp.logger.Println(fmt.Sprintf("[%s] stopped", service.GetName()))
-				sp.onStopService()
-				return
-			} else if err != nil {
-				sp.logger.Println(fmt.Sprintf("[%s] %s", service.GetName(), err.Error()))
-
-				errorCount++
-				if errorCount > 1000 {
-					panic(service.GetName() + " generate too more errors")
-				}
-				if time.Now().Sub(lastEventTime) > 10*time.Second {
-					errorCount = 0
-				}
-			} else {
-				sp.logger.Println(fmt.Sprintf("[%s] Restarted", service.GetName()))
+		deadline := time.NewTimer(sp.shutdownTimeout)
+		defer deadline.Stop()
+		clean := true
+		for i := len(order) - 1; i >= 0; i-- {
+			state := order[i]
+			stopped, expired := sp.stopService(state, deadline.C)
+			clean = clean && stopped
+			if expired {
+				sp.logger.Warn("shutdown deadline passed", "timeout", sp.shutdownTimeout, "left", i)
+				clean = false
+				break
 			}
 		}
+		result <- clean
 	}()
+	return result
 }
 
-func (sp *ServicePoll) onStopService() {
-	sp.stopWait--
-	if sp.stopWait <= 0 {
-		sp.stop <- true
+// Returns whether the service stopped in time and whether the shutdown deadline passed
+func (sp *ServicePoll) stopService(state *serviceState, deadline <-chan time.Time) (bool, bool) {
+	state.logger.Info("stopping")
+	state.stopOnce.Do(func() {
+		close(state.stop)
+	})
+	sp.mutex.Lock()
+	running := state.state == ServiceRunning
+	sp.mutex.Unlock()
+	// a service waiting for dependencies or for a restart has nothing to stop, a running one
+	// is done when Stop and Start both returned, Stop may do the last work like a final flush
+	stopReturned := make(chan bool)
+	if running {
+		go func() {
+			defer close(stopReturned)
+			err := state.service.Stop()
+			if err != nil {
+				state.logger.Error("stop failed", "error", err)
+			}
+		}()
 	} else {
-		sp.logger.Printf("Wait for %d servces", sp.stopWait)
+		close(stopReturned)
+	}
+	timeout := state.stopTimeout
+	if timeout == 0 {
+		timeout = sp.stopTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	done := state.done
+	for done != nil || stopReturned != nil {
+		select {
+		case <-done:
+			done = nil
+		case <-stopReturned:
+			stopReturned = nil
+		case <-timer.C:
+			state.logger.Warn("did not stop in time", "timeout", timeout)
+			return false, false
+		case <-deadline:
+			return false, true
+		}
+	}
+	return true, false
+}
+
+func (sp *ServicePoll) run(state *serviceState) {
+	defer close(state.done)
+	if !sp.waitDependencies(state) {
+		sp.stopped(state, nil)
+		return
+	}
+	for {
+		if resetter, ok := state.service.(StopResetter); ok {
+			resetter.ResetStop()
+		}
+		if !sp.setRunning(state) {
+			sp.stopped(state, nil)
+			return
+		}
+		started := time.Now()
+		err := state.service.Start()
+		failures := sp.setExited(state, err, started)
+		if sp.isStopping(state) {
+			sp.stopped(state, err)
+			return
+		}
+		// a service that returned without error is restarted too, after the shortest delay so
+		// one that keeps returning at once does not spin
+		delay := backoffMin
+		if err == nil {
+			state.logger.Info("returned, restarting", "restart_in", delay)
+		} else {
+			delay = backoff(failures)
+			state.logger.Error("failed", "error", err, "restart_in", delay, "failures", failures)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-state.stop:
+			timer.Stop()
+			sp.stopped(state, nil)
+			return
+		}
+	}
+}
+
+func (sp *ServicePoll) stopped(state *serviceState, err error) {
+	if err != nil {
+		state.logger.Error("failed", "error", err)
+	}
+	sp.mutex.Lock()
+	state.state = ServiceStopped
+	state.since = time.Now().UTC()
+	sp.mutex.Unlock()
+	state.logger.Info("stopped")
+}
+
+// Exponential with ±20% jitter, so services failing together do not retry together
+func backoff(failures int) time.Duration {
+	delay := backoffMin
+	for i := 1; i < failures && delay < backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > backoffMax {
+		delay = backoffMax
+	}
+	return time.Duration(float64(delay) * (0.8 + 0.4*rand.Float64()))
+}
+
+// A dependency is ready once it runs and passes its health check, false when the service was
+// stopped while waiting
+func (sp *ServicePoll) waitDependencies(state *serviceState) bool {
+	if len(state.dependencies) == 0 {
+		return true
+	}
+	deadline := time.Now().Add(dependencyTimeout)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for _, dependency := range state.dependencies {
+		for !sp.ready(dependency) {
+			if time.Now().After(deadline) {
+				state.logger.Warn("starting without dependency ready", "dependency", dependency.name)
+				break
+			}
+			select {
+			case <-ticker.C:
+			case <-state.stop:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (sp *ServicePoll) ready(state *serviceState) bool {
+	sp.mutex.Lock()
+	running := state.state == ServiceRunning
+	sp.mutex.Unlock()
+	if !running {
+		return false
+	}
+	if checker, ok := state.service.(HealthChecker); ok {
+		return checker.CheckHealth() == nil
+	}
+	return true
+}
+
+func (sp *ServicePoll) isStopping(state *serviceState) bool {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	return state.stopping
+}
+
+// Dependencies first, otherwise in the order services were pushed. A cycle is logged and
+// broken at the service that closes it
+func (sp *ServicePoll) order() []*serviceState {
+	result := make([]*serviceState, 0, len(sp.states))
+	visited := make(map[*serviceState]bool)
+	visiting := make(map[*serviceState]bool)
+	var visit func(state *serviceState)
+	visit = func(state *serviceState) {
+		if visited[state] {
+			return
+		}
+		if visiting[state] {
+			state.logger.Error("dependency cycle")
+			return
+		}
+		visiting[state] = true
+		for _, dependency := range state.dependencies {
+			visit(dependency)
+		}
+		visiting[state] = false
+		if !visited[state] {
+			visited[state] = true
+			result = append(result, state)
+		}
+	}
+	for _, state := range sp.states {
+		visit(state)
 	}
+	return result
 }
@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testService struct {
+	name    string
+	hang    bool
+	release chan bool
+	once    sync.Once
+	log     *stopLog
+}
+
+type stopLog struct {
+	mutex sync.Mutex
+	names []string
+}
+
+func createTestService(name string, hang bool, log *stopLog) *testService {
+	return &testService{name: name, hang: hang, release: make(chan bool), log: log}
+}
+
+func (service *testService) Start() error {
+	<-service.release
+	return nil
+}
+
+func (service *testService) GetName() string {
+	return service.name
+}
+
+func (service *testService) Stop() error {
+	service.log.mutex.Lock()
+	service.log.names = append(service.log.names, service.name)
+	service.log.mutex.Unlock()
+	if !service.hang {
+		service.once.Do(func() {
+			close(service.release)
+		})
+	}
+	return nil
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 1, want: backoffMin},
+		{failures: 2, want: 2 * backoffMin},
+		{failures: 3, want: 4 * backoffMin},
+		{failures: 7, want: 64 * backoffMin},
+		{failures: 8, want: backoffMax},
+		{failures: 1000, want: backoffMax},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			got := backoff(test.failures)
+			low := time.Duration(float64(test.want) * 0.8)
+			high := time.Duration(float64(test.want) * 1.2)
+			if got < low || got > high {
+				t.Errorf("%d failures: %s, want %s ±20%%", test.failures, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestServicePollOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		services  []string
+		dependsOn [][2]string
+		want      []string
+	}{
+		{name: "push order", services: []string{"a", "b", "c"}, want: []string{"a", "b", "c"}},
+		{
+			name:      "dependencies first",
+			services:  []string{"http", "alerts", "saver"},
+			dependsOn: [][2]string{{"http", "saver"}, {"alerts", "saver"}},
+			want:      []string{"saver", "http", "alerts"},
+		},
+		{
+			name:      "chain",
+			services:  []string{"a", "b", "c"},
+			dependsOn: [][2]string{{"a", "b"}, {"b", "c"}},
+			want:      []string{"c", "b", "a"},
+		},
+		{
+			name:      "cycle is broken once",
+			services:  []string{"a", "b", "c"},
+			dependsOn: [][2]string{{"a", "b"}, {"b", "a"}},
+			want:      []string{"b", "a", "c"},
+		},
+		{
+			name:      "self dependency is ignored",
+			services:  []string{"a", "b"},
+			dependsOn: [][2]string{{"a", "a"}},
+			want:      []string{"a", "b"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			poll := GetServicePoll(CreateLogger(ioutil.Discard))
+			services := make(map[string]Service)
+			for _, name := range test.services {
+				services[name] = createTestService(name, false, &stopLog{})
+				poll.Push(services[name])
+			}
+			for _, pair := range test.dependsOn {
+				poll.DependsOn(services[pair[0]], services[pair[1]])
+			}
+			var got []string
+			for _, state := range poll.order() {
+				got = append(got, state.name)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestServicePollStopAll(t *testing.T) {
+	tests := []struct {
+		name      string
+		hang      string
+		shutdown  time.Duration
+		wantClean bool
+		wantStops []string
+	}{
+		{name: "reverse dependency order", shutdown: 5 * time.Second, wantClean: true, wantStops: []string{"listener", "sender", "saver"}},
+		{name: "stop timeout", hang: "sender", shutdown: 5 * time.Second, wantClean: false, wantStops: []string{"listener", "sender", "saver"}},
+		{name: "shutdown deadline", hang: "sender", shutdown: 50 * time.Millisecond, wantClean: false, wantStops: []string{"listener", "sender"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			log := &stopLog{}
+			poll := GetServicePoll(CreateLogger(ioutil.Discard))
+			poll.SetTimeouts(100*time.Millisecond, test.shutdown)
+			saver := createTestService("saver", test.hang == "saver", log)
+			listener := createTestService("listener", test.hang == "listener", log)
+			sender := createTestService("sender", test.hang == "sender", log)
+			poll.Push(saver)
+			poll.Push(listener)
+			poll.Push(sender)
+			poll.DependsOn(sender, saver)
+			poll.DependsOn(listener, sender)
+			poll.RunAll()
+			waitRunning(t, &poll)
+
+			if clean := <-poll.StopAll(); clean != test.wantClean {
+				t.Errorf("clean %v, want %v", clean, test.wantClean)
+			}
+			log.mutex.Lock()
+			defer log.mutex.Unlock()
+			if !reflect.DeepEqual(log.names, test.wantStops) {
+				t.Errorf("stopped %v, want %v", log.names, test.wantStops)
+			}
+		})
+	}
+}
+
+func waitRunning(t *testing.T, poll *ServicePoll) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		running := true
+		for _, status := range poll.Statuses() {
+			running = running && status.State == ServiceRunning
+		}
+		if running {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("services did not start")
+}
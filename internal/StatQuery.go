@@ -0,0 +1,309 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const MaxSeriesPoints = 10000
+
+var queryAppName = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+var seriesAggregates = map[string]string{
+	"sum":   "sum(value)",
+	"avg":   "avg(value)",
+	"min":   "min(value)",
+	"max":   "max(value)",
+	"count": "count(*)::double precision",
+	"last":  "(array_agg(value order by created_at desc))[1]",
+}
+
+var seriesSources = map[string]string{
+	"raw":  "",
+	"hour": HourRollupPrefix,
+	"day":  DayRollupPrefix,
+}
+
+type SeriesQuery struct {
+	App     string
+	Metric  string
+	Pattern string
+	From    time.Time
+	To      time.Time
+	Step    int
+	Agg     string
+	By      string
+	Source  string
+	Tags    map[string]string
+}
+
+type Series struct {
+	NodeId  *int              `json:"node_id,omitempty"`
+	Pattern string            `json:"pattern,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Points  [][2]float64      `json:"points"`
+}
+
+type AppMetrics struct {
+	Int    []string `json:"int"`
+	String []string `json:"string"`
+}
+
+func (saver *StatSaver) tableExists(name string) (bool, error) {
+	exists := false
+	err := saver.connection.QueryRow(context.Background(), `select exists(select 1 from information_schema.tables
+where table_schema = current_schema() and table_name = $1)`, name).Scan(&exists)
+	return exists, err
+}
+
+// ListApps returns names of apps that have metric tables, dashes are stored as underscores
+func (saver *StatSaver) ListApps() ([]string, error) {
+	rows, err := saver.connection.Query(context.Background(), `select table_name from information_schema.tables
+where table_schema = current_schema() and table_name like 't\_%'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	apps := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		if isStringTable(name) {
+			apps[strings.TrimPrefix(name, "t_str_")] = true
+		} else {
+			apps[strings.TrimPrefix(name, "t_")] = true
+		}
+	}
+	result := make([]string, 0, len(apps))
+	for name := range apps {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result, rows.Err()
+}
+
+// ListMetrics returns metric names written by the app since from
+func (saver *StatSaver) ListMetrics(app string, from time.Time) (AppMetrics, error) {
+	result := AppMetrics{Int: []string{}, String: []string{}}
+	if !queryAppName.MatchString(app) {
+		return result, errors.New("bad app name")
+	}
+	var err error
+	result.Int, err = saver.metricNames(getIntTableName(app), from)
+	if err != nil {
+		return result, err
+	}
+	result.String, err = saver.metricNames(getStringTableName(app), from)
+	return result, err
+}
+
+func (saver *StatSaver) metricNames(table string, from time.Time) ([]string, error) {
+	names := []string{}
+	exists, err := saver.tableExists(table)
+	if err != nil || !exists {
+		return names, err
+	}
+	rows, err := saver.connection.Query(context.Background(),
+		"select distinct type from "+table+" where created_at >= $1 order by type", from.UTC())
+	if err != nil {
+		return names, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// ListPatterns returns patterns of a string metric written since from
+func (saver *StatSaver) ListPatterns(app, metric string, from time.Time) ([]string, error) {
+	patterns := []string{}
+	if !queryAppName.MatchString(app) {
+		return patterns, errors.New("bad app name")
+	}
+	table := getStringTableName(app)
+	exists, err := saver.tableExists(table)
+	if err != nil || !exists {
+		return patterns, err
+	}
+	rows, err := saver.connection.Query(context.Background(),
+		"select distinct pattern from "+table+" where type = $1 and created_at >= $2 order by pattern limit 1000",
+		metric, from.UTC())
+	if err != nil {
+		return patterns, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pattern string
+		err = rows.Scan(&pattern)
+		if err != nil {
+			return patterns, err
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, rows.Err()
+}
+
+// Series aggregates a metric into step second buckets, across all nodes or per node, pattern
+// or value of one tag (by tag:key). Only rows having all of query.Tags are taken
+func (saver *StatSaver) Series(query SeriesQuery) ([]Series, error) {
+	if !queryAppName.MatchString(query.App) {
+		return nil, errors.New("bad app name")
+	}
+	if query.Step < 1 {
+		return nil, errors.New("step must be positive")
+	}
+	if !query.To.After(query.From) {
+		return nil, errors.New("to must be after from")
+	}
+	if int(query.To.Sub(query.From).Seconds())/query.Step > MaxSeriesPoints {
+		return nil, fmt.Errorf("too many points, max %d", MaxSeriesPoints)
+	}
+	prefix, has := seriesSources[query.Source]
+	if !has {
+		return nil, errors.New("source must be raw, hour or day")
+	}
+	byTag := ""
+	if strings.HasPrefix(query.By, "tag:") {
+		byTag = strings.TrimPrefix(query.By, "tag:")
+		if !tagKeyPattern.MatchString(byTag) {
+			return nil, errors.New("bad tag in by")
+		}
+	} else if query.By != "" && query.By != "node" && query.By != "pattern" {
+		return nil, errors.New("by must be node, pattern or tag:key")
+	}
+
+	withPattern := query.Pattern != "" || query.By == "pattern"
+	table := getIntTableName(query.App)
+	if withPattern {
+		table = getStringTableName(query.App)
+	}
+	if prefix != "" {
+		table = getRollupTableName(prefix, table)
+	}
+	exists, err := saver.tableExists(table)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return []Series{}, nil
+	}
+
+	aggregate, err := saver.seriesAggregate(table, query)
+	if err != nil {
+		return nil, err
+	}
+	group := ""
+	if query.By == "node" {
+		group = ",node_id"
+	} else if query.By == "pattern" {
+		group = ",pattern"
+	} else if byTag != "" {
+		// key is checked by tagKeyPattern so it can not break out of the literal
+		group = ",tags->>'" + byTag + "'"
+	}
+	where := "type = $1 AND created_at >= $2 AND created_at < $3"
+	args := []interface{}{query.Metric, query.From.UTC(), query.To.UTC(), query.Step}
+	if query.Pattern != "" {
+		args = append(args, query.Pattern)
+		where += fmt.Sprintf(" AND pattern = $%d", len(args))
+	}
+	if len(query.Tags) > 0 {
+		args = append(args, query.Tags)
+		where += fmt.Sprintf(" AND tags @> $%d::jsonb", len(args))
+	}
+	sqlStr := "SELECT (floor(extract(epoch from created_at) / $4) * $4)::bigint AS bucket" + group + "," + aggregate +
+		" FROM " + table + " WHERE " + where + " GROUP BY bucket" + group + " ORDER BY bucket"
+
+	rows, err := saver.connection.Query(context.Background(), sqlStr, args...)
+	if err != nil {
+		saver.logger.Error("bad sql", "sql", sqlStr)
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Series
+	index := make(map[string]int)
+	for rows.Next() {
+		var bucket int64
+		var value float64
+		var nodeId int
+		var pattern string
+		var tagValue *string
+		key := ""
+		switch {
+		case query.By == "node":
+			err = rows.Scan(&bucket, &nodeId, &value)
+			key = intToString(nodeId)
+		case query.By == "pattern":
+			err = rows.Scan(&bucket, &pattern, &value)
+			key = pattern
+		case byTag != "":
+			err = rows.Scan(&bucket, &tagValue, &value)
+			if tagValue != nil {
+				key = *tagValue
+			}
+		default:
+			err = rows.Scan(&bucket, &value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		i, has := index[key]
+		if !has {
+			series := Series{Pattern: pattern, Points: [][2]float64{}}
+			if query.By == "node" {
+				id := nodeId
+				series.NodeId = &id
+			}
+			// rows without the tag are grouped into a series with no tags
+			if tagValue != nil {
+				series.Tags = map[string]string{byTag: *tagValue}
+			}
+			result = append(result, series)
+			i = len(result) - 1
+			index[key] = i
+		}
+		result[i].Points = append(result[i].Points, [2]float64{float64(bucket), value})
+	}
+	if result == nil {
+		result = []Series{}
+	}
+	return result, rows.Err()
+}
+
+// Without an explicit function metrics are folded the same way rollups fold them
+func (saver *StatSaver) seriesAggregate(table string, query SeriesQuery) (string, error) {
+	if query.Agg != "" {
+		aggregate, has := seriesAggregates[query.Agg]
+		if !has {
+			return "", errors.New("agg must be one of sum, avg, min, max, count, last")
+		}
+		return aggregate, nil
+	}
+	var kind *string
+	err := saver.connection.QueryRow(context.Background(),
+		"select max(kind) from "+table+" where type = $1 and created_at >= $2 and created_at < $3",
+		query.Metric, query.From.UTC(), query.To.UTC()).Scan(&kind)
+	if err != nil {
+		return "", err
+	}
+	if kind != nil {
+		if aggregate, has := rollupAggregates[*kind]; has {
+			return aggregate, nil
+		}
+	}
+	return seriesAggregates["avg"], nil
+}
@@ -2,12 +2,13 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/jackc/pgx/pgxpool"
-	"log"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -29,102 +30,191 @@ func getStringTableName(appName string) string {
 	return "t_str_" + strings.ReplaceAll(appName, "-", "_")
 }
 
+// SaveListener is told about every batch StatSaver has stored, it must not block
+type SaveListener interface {
+	SavedInt(data map[string]map[string]MetricValue, at time.Time)
+	SavedString(data map[string]map[string]PatternValues, at time.Time)
+}
+
+var errNotConnected = errors.New("not connected to postgres")
+
 type StatSaver struct {
-	logger         *log.Logger
+	logger         *Logger
 	databaseUrl    string
 	connection     *pgxpool.Pool
+	migrator       *Migrator
 	stop           chan bool
+	mutex          sync.Mutex
 	existingTables map[string]bool
+	listeners      []SaveListener
 	sum            func(name string, value int)
+	self           *SelfStat
 }
 
-func CreateStatSaver(logger *log.Logger, url string, sum func(name string, value int)) *StatSaver {
+func CreateStatSaver(logger *Logger, url string, sum func(name string, value int)) *StatSaver {
 	return &StatSaver{
-		logger:         logger,
+		logger:         logger.Named("StatSaver"),
 		databaseUrl:    url,
 		existingTables: make(map[string]bool),
 		sum:            sum,
+		stop:           make(chan bool, 1),
 	}
 }
 
-func (saver *StatSaver) Start() error {
-	config, err := pgxpool.ParseConfig(saver.databaseUrl)
+func ConnectPostgres(url string) (*pgxpool.Pool, error) {
+	config, err := pgxpool.ParseConfig(url)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	config.MaxConns = 10
 	config.HealthCheckPeriod = 180 * time.Second
 	config.MaxConnLifetime = 10 * time.Minute
 
-	conn, err := pgxpool.ConnectConfig(context.Background(), config)
+	return pgxpool.ConnectConfig(context.Background(), config)
+}
+
+func (saver *StatSaver) Start() error {
+	conn, err := ConnectPostgres(saver.databaseUrl)
 	if err != nil {
 		return err
 	}
+	// tables are brought up to date before anything is saved, a migration may rewrite a whole
+	// table and should not hold inserts behind it. Until then CheckHealth fails and dependent
+	// services wait
+	migrator := CreateMigrator(conn, saver.logger)
+	planned, err := migrator.MigrateAll(false)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if len(planned) > 0 {
+		saver.logger.Info("tables migrated", "migrations", len(planned))
+	}
+	saver.mutex.Lock()
+	// a Stop during the migrations had no connection to close
+	select {
+	case <-saver.stop:
+		saver.mutex.Unlock()
+		conn.Close()
+		return nil
+	default:
+	}
 	saver.connection = conn
-	saver.stop = make(chan bool, 1)
+	saver.migrator = migrator
+	saver.mutex.Unlock()
 	<-saver.stop
 	return nil
 }
 
 func (saver *StatSaver) Stop() error {
-	saver.connection.Close()
+	saver.mutex.Lock()
+	if saver.connection != nil {
+		saver.connection.Close()
+	}
+	saver.mutex.Unlock()
 	//err := saver.connection.Close(context.Background())
-	saver.stop <- false
+	select {
+	case saver.stop <- false:
+	default:
+	}
 	return nil
 }
 
+// CheckHealth tells whether Postgres answers
+func (saver *StatSaver) CheckHealth() error {
+	saver.mutex.Lock()
+	connection := saver.connection
+	saver.mutex.Unlock()
+	if connection == nil {
+		return errNotConnected
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := connection.Exec(ctx, "select 1")
+	return err
+}
+
 func (saver *StatSaver) GetName() string {
 	return "StatSaver"
 }
 
-func (saver *StatSaver) SaveInt(data map[string]map[string]int) {
+func (saver *StatSaver) SetSelfStat(self *SelfStat) {
+	saver.self = self
+}
+
+// AddListener must be called before the saver gets data
+func (saver *StatSaver) AddListener(listener SaveListener) {
+	saver.listeners = append(saver.listeners, listener)
+}
+
+func (saver *StatSaver) SaveInt(data map[string]map[string]MetricValue) error {
+	return saver.SaveIntAt(data, time.Now().UTC())
+}
+
+// SaveIntAt stores metrics collected at the given moment instead of now. Apps with bad names
+// are logged and skipped, the error is the last one Postgres gave
+func (saver *StatSaver) SaveIntAt(data map[string]map[string]MetricValue, at time.Time) error {
+	var result error
 	count := 0
 	for appName, data := range data {
 		if len(data) > 0 {
 			if isValidAppName(appName) {
-				saver.SaveAppDataInt(appName, data)
+				if err := saver.SaveAppDataInt(appName, data, at); err != nil {
+					result = err
+				}
 				count++
 			} else {
-				saver.logger.Println("Invalid app name", appName)
+				saver.logger.Warn("invalid app name", "app", appName)
 				saver.sum("invalid_app", 1)
 			}
 		} else {
-			saver.logger.Println("No data from app", appName)
+			saver.logger.Warn("no data from app", "app", appName)
 			saver.sum("invalid_app", 1)
 		}
 	}
+	for _, listener := range saver.listeners {
+		listener.SavedInt(data, at)
+	}
 	saver.sum("saved", 1)
+	return result
 }
 
-func (saver *StatSaver) SaveAppDataInt(appName string, data map[string]int) {
+func (saver *StatSaver) SaveAppDataInt(appName string, data map[string]MetricValue, at time.Time) error {
 	appParts := strings.Split(appName, "/")
 	if len(appParts) != 2 {
-		saver.logger.Println("Bad app parts", appName)
-		return
+		saver.logger.Warn("bad app parts", "app", appName)
+		return nil
 	}
 	nodeId, err := strconv.Atoi(appParts[1])
 	if err != nil {
-		saver.logger.Println("Bad node id", appName, err)
-		return
+		saver.logger.Warn("bad node id", "app", appName, "error", err)
+		return nil
 	}
 	table := getIntTableName(appParts[0])
 	err = saver.createTableIntMetric(table)
 	if err != nil {
-		saver.logger.Println("Table not created", appName, err)
-		return
+		saver.logger.Error("table not created", "app", appName, "error", err)
+		return err
 	}
-	err = saver.saveIntMetrics(table, nodeId, data)
+	started := time.Now()
+	err = saver.saveIntMetrics(table, nodeId, data, at)
+	saver.self.Duration("db_insert_ms", "int", started)
 	if err != nil {
+		saver.self.StrSum("db_insert_errors", 1, "int")
 		saver.sum("save_error", 1)
-		saver.logger.Println("Data saveIntMetrics fail", appName, err)
-		return
+		saver.logger.Error("save int metrics failed", "app", appName, "error", err)
+		return err
 	}
+	return nil
 }
 
 func (saver *StatSaver) createTableIntMetric(name string) error {
-	if _, has := saver.existingTables[name]; has {
+	if saver.hasTable(name) {
 		return nil
 	}
+	if !saver.connected() {
+		return errNotConnected
+	}
 	_, err := saver.connection.Exec(context.Background(), `create table IF NOT EXISTS `+name+`
 (
 	created_at timestamp default now(),
@@ -134,76 +224,117 @@ func (saver *StatSaver) createTableIntMetric(name string) error {
 );
 create index IF NOT EXISTS `+name+`_created_at_index on `+name+` (created_at desc);
 `)
-
+	if err != nil {
+		return err
+	}
+	// existing tables were migrated on start, this only catches up new ones
+	_, err = saver.migrator.Migrate(name, false)
 	if err == nil {
-		saver.existingTables[name] = true
+		saver.addTable(name)
 	}
 	return err
 }
 
-func (saver *StatSaver) saveIntMetrics(tableName string, nodeId int, data map[string]int) error {
-	now := time.Now().UTC()
-	sqlStr := "INSERT INTO " + tableName + "(created_at,type,value,node_id) VALUES "
+// Tables can not be created before Start connected and migrated the existing ones
+func (saver *StatSaver) connected() bool {
+	saver.mutex.Lock()
+	defer saver.mutex.Unlock()
+	return saver.migrator != nil
+}
+
+func (saver *StatSaver) hasTable(name string) bool {
+	saver.mutex.Lock()
+	defer saver.mutex.Unlock()
+	return saver.existingTables[name]
+}
+
+func (saver *StatSaver) addTable(name string) {
+	saver.mutex.Lock()
+	saver.existingTables[name] = true
+	saver.mutex.Unlock()
+}
+
+func (saver *StatSaver) saveIntMetrics(tableName string, nodeId int, data map[string]MetricValue, now time.Time) error {
+	sqlStr := "INSERT INTO " + tableName + "(created_at,type,value,node_id,kind,tags) VALUES "
 	var values []interface{}
 
 	x := 1
-	for name, val := range data {
-		sqlStr += fmt.Sprintf("($%d,$%d,$%d,$%d),", x, x+1, x+2, x+3)
-		values = append(values, now, name, val, nodeId)
-		x += 4
+	for key, val := range data {
+		name, tags := splitTaggedName(key)
+		sqlStr += fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d),", x, x+1, x+2, x+3, x+4, x+5)
+		values = append(values, now, name, val.Value, nodeId, nullableKind(val.Kind), nullableTags(tags))
+		x += 6
 	}
 	//trim the last ,
 	sqlStr = sqlStr[0 : len(sqlStr)-1]
 	_, err := saver.connection.Exec(context.Background(), sqlStr, values...)
 	if err != nil {
-		saver.logger.Println("Bad sql", sqlStr)
+		saver.logger.Error("bad sql", "sql", sqlStr)
 	}
 	return err
 }
 
-func (saver *StatSaver) SaveString(data map[string]map[string]map[string]int) {
+func (saver *StatSaver) SaveString(data map[string]map[string]PatternValues) error {
+	return saver.SaveStringAt(data, time.Now().UTC())
+}
+
+func (saver *StatSaver) SaveStringAt(data map[string]map[string]PatternValues, at time.Time) error {
+	var result error
 	count := 0
 	for appName, data := range data {
 		if isValidAppName(appName) {
-			saver.SaveAppDataString(appName, data)
+			if err := saver.SaveAppDataString(appName, data, at); err != nil {
+				result = err
+			}
 			count++
 		} else {
-			saver.logger.Println("Invalid app name", appName)
+			saver.logger.Warn("invalid app name", "app", appName)
 			saver.sum("invalid_app", 1)
 		}
 	}
+	for _, listener := range saver.listeners {
+		listener.SavedString(data, at)
+	}
 	saver.sum("saved", 1)
+	return result
 }
 
-func (saver *StatSaver) SaveAppDataString(appName string, data map[string]map[string]int) {
+func (saver *StatSaver) SaveAppDataString(appName string, data map[string]PatternValues, at time.Time) error {
 	appParts := strings.Split(appName, "/")
 	if len(appParts) != 2 {
-		saver.logger.Println("Bad app parts", appName)
-		return
+		saver.logger.Warn("bad app parts", "app", appName)
+		return nil
 	}
 	nodeId, err := strconv.Atoi(appParts[1])
 	if err != nil {
-		saver.logger.Println("Bad node id", appName, err)
-		return
+		saver.logger.Warn("bad node id", "app", appName, "error", err)
+		return nil
 	}
 	table := getStringTableName(appParts[0])
 	err = saver.createTableStringMetric(table)
 	if err != nil {
-		saver.logger.Println("Table not created", appName, err)
-		return
+		saver.logger.Error("table not created", "app", appName, "error", err)
+		return err
 	}
-	err = saver.saveStringMetrics(table, nodeId, data)
+	started := time.Now()
+	err = saver.saveStringMetrics(table, nodeId, data, at)
+	saver.self.Duration("db_insert_ms", "string", started)
 	if err != nil {
+		saver.self.StrSum("db_insert_errors", 1, "string")
 		saver.sum("save_error", 1)
-		saver.logger.Println("Data saveStringMetrics fail", appName, err)
-		return
+		saver.logger.Error("save string metrics failed", "app", appName, "error", err)
+		return err
 	}
+	return nil
 }
 
 func (saver *StatSaver) createTableStringMetric(name string) error {
-	if _, has := saver.existingTables[name]; has {
+	if saver.hasTable(name) {
 		return nil
 	}
+	if !saver.connected() {
+		return errNotConnected
+	}
 	_, err := saver.connection.Exec(context.Background(), `create table IF NOT EXISTS `+name+`
 (
 	created_at timestamp default now(),
@@ -214,20 +345,26 @@ func (saver *StatSaver) createTableStringMetric(name string) error {
 );
 create index IF NOT EXISTS `+name+`_created_at_index on `+name+` (created_at desc);
 `)
-
+	if err != nil {
+		return err
+	}
+	_, err = saver.migrator.Migrate(name, false)
 	if err == nil {
-		saver.existingTables[name] = true
+		saver.addTable(name)
 	}
 	return err
 }
 
-func (saver *StatSaver) saveStringMetrics(tableName string, nodeId int, data map[string]map[string]int) error {
-	now := time.Now().UTC()
-	sqlStr := "INSERT INTO " + tableName + "(created_at,type,pattern,value,node_id) VALUES "
+func (saver *StatSaver) saveStringMetrics(tableName string, nodeId int, data map[string]PatternValues, now time.Time) error {
+	sqlStr := "INSERT INTO " + tableName + "(created_at,type,pattern,value,node_id,kind,tags) VALUES "
 	var values []interface{}
 
 	x := 1
-	for name, list := range data {
+	for key, metric := range data {
+		name, tagMap := splitTaggedName(key)
+		list := metric.Values
+		kind := nullableKind(metric.Kind)
+		tags := nullableTags(tagMap)
 		if strings.HasSuffix(name, "_group_id") {
 			groupIds := make([]string, 0, len(list))
 
@@ -251,19 +388,19 @@ func (saver *StatSaver) saveStringMetrics(tableName string, nodeId int, data map
 				}
 			}
 			for pattern, count := range list {
-				sqlStr += fmt.Sprintf("($%d,$%d,$%d,$%d,$%d),", x, x+1, x+2, x+3, x+4)
+				sqlStr += fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d,$%d),", x, x+1, x+2, x+3, x+4, x+5, x+6)
 				if gId, has := nameIndex[pattern]; has {
-					values = append(values, now, name, pattern, count, gId)
+					values = append(values, now, name, pattern, count, gId, kind, tags)
 				} else {
-					values = append(values, now, name, pattern, count, nodeId)
+					values = append(values, now, name, pattern, count, nodeId, kind, tags)
 				}
-				x += 5
+				x += 7
 			}
 		} else {
 			for pattern, count := range list {
-				sqlStr += fmt.Sprintf("($%d,$%d,$%d,$%d,$%d),", x, x+1, x+2, x+3, x+4)
-				values = append(values, now, name, truncateString(pattern, 200), count, nodeId)
-				x += 5
+				sqlStr += fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d,$%d),", x, x+1, x+2, x+3, x+4, x+5, x+6)
+				values = append(values, now, name, truncateString(pattern, 200), count, nodeId, kind, tags)
+				x += 7
 			}
 		}
 	}
@@ -271,11 +408,19 @@ func (saver *StatSaver) saveStringMetrics(tableName string, nodeId int, data map
 	sqlStr = sqlStr[0 : len(sqlStr)-1]
 	_, err := saver.connection.Exec(context.Background(), sqlStr, values...)
 	if err != nil {
-		saver.logger.Println("Bad sql", sqlStr)
+		saver.logger.Error("bad sql", "sql", sqlStr)
 	}
 	return err
 }
 
+// Rows from senders that do not report kinds keep NULL
+func nullableKind(kind string) interface{} {
+	if kind == "" {
+		return nil
+	}
+	return kind
+}
+
 func truncateString(str string, num int) string {
 	bnoden := str
 	if len(str) > num {
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Tags are key=value dimensions of a metric, written after the name like in Graphite:
+// RL:AppName:ParamName;region=eu;platform=ios:TYPE:VALUE[:pattern]
+// Every tag set is aggregated on its own, inside the proxy it travels as name;k=v;k=v
+// with keys sorted, StatSaver stores it in the jsonb tags column
+
+const MaxTagSets = 100
+const MaxRecordTags = 10
+
+var tagKeyPattern = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+
+// Splits ParamName;k=v;k=v into the name and its tags, nil tags when there are none
+func parseTaggedName(value string) (string, map[string]string, error) {
+	parts := strings.Split(value, ";")
+	if len(parts) == 1 {
+		return value, nil, nil
+	}
+	if len(parts)-1 > MaxRecordTags {
+		return "", nil, fmt.Errorf("Too many tags, max %d: %s", MaxRecordTags, value)
+	}
+	tags := make(map[string]string, len(parts)-1)
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || !tagKeyPattern.MatchString(kv[0]) || kv[1] == "" {
+			return "", nil, fmt.Errorf("Bad tag %s: %s", part, value)
+		}
+		tags[kv[0]] = truncateString(kv[1], 100)
+	}
+	return parts[0], tags, nil
+}
+
+// Canonical form of a tag set: k=v;k=v with keys sorted
+func tagSetKey(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, key+"="+tags[key])
+	}
+	return strings.Join(parts, ";")
+}
+
+func joinTagged(name, tagKey string) string {
+	if tagKey == "" {
+		return name
+	}
+	return name + ";" + tagKey
+}
+
+// TaggedName is the key a metric with tags has in taken and sent metric maps
+func TaggedName(name string, tags map[string]string) string {
+	return joinTagged(name, tagSetKey(tags))
+}
+
+// Reverse of TaggedName, malformed tags are skipped
+func splitTaggedName(key string) (string, map[string]string) {
+	parts := strings.Split(key, ";")
+	if len(parts) == 1 {
+		return key, nil
+	}
+	tags := make(map[string]string, len(parts)-1)
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 {
+			tags[kv[0]] = kv[1]
+		}
+	}
+	return parts[0], tags
+}
+
+// Tags are written as NULL when there are none so untagged rows stay as they were
+func nullableTags(tags map[string]string) interface{} {
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseTaggedName(t *testing.T) {
+	tooMany := "name"
+	for i := 0; i <= MaxRecordTags; i++ {
+		tooMany += ";k" + strconv.Itoa(i) + "=v"
+	}
+	tests := []struct {
+		name     string
+		value    string
+		wantName string
+		wantTags map[string]string
+		wantErr  bool
+	}{
+		{name: "no tags", value: "requests", wantName: "requests"},
+		{
+			name:     "tags",
+			value:    "requests;region=eu;platform=ios",
+			wantName: "requests",
+			wantTags: map[string]string{"region": "eu", "platform": "ios"},
+		},
+		{
+			name:     "value may hold =",
+			value:    "requests;query=a=b",
+			wantName: "requests",
+			wantTags: map[string]string{"query": "a=b"},
+		},
+		{
+			name:     "long value is truncated",
+			value:    "requests;id=" + strings.Repeat("x", 150),
+			wantName: "requests",
+			wantTags: map[string]string{"id": strings.Repeat("x", 97) + "..."},
+		},
+		{name: "no value", value: "requests;region=", wantErr: true},
+		{name: "no =", value: "requests;region", wantErr: true},
+		{name: "bad key", value: "requests;re gion=eu", wantErr: true},
+		{name: "empty tag", value: "requests;", wantErr: true},
+		{name: "too many tags", value: tooMany, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, tags, err := parseTaggedName(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if name != test.wantName || !reflect.DeepEqual(tags, test.wantTags) {
+				t.Errorf("got %s %v, want %s %v", name, tags, test.wantName, test.wantTags)
+			}
+		})
+	}
+}
+
+func TestTaggedNameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		tags map[string]string
+		want string
+	}{
+		{name: "no tags", want: "requests"},
+		{name: "sorted keys", tags: map[string]string{"region": "eu", "platform": "ios"}, want: "requests;platform=ios;region=eu"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := TaggedName("requests", test.tags)
+			if key != test.want {
+				t.Fatalf("got %s, want %s", key, test.want)
+			}
+			name, tags := splitTaggedName(key)
+			if name != "requests" || len(tags) != len(test.tags) || (len(tags) > 0 && !reflect.DeepEqual(tags, test.tags)) {
+				t.Errorf("split into %s %v, want requests %v", name, tags, test.tags)
+			}
+		})
+	}
+}
+
+func TestTaggedLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxMetrics int
+		sets       int
+		wantSets   int
+	}{
+		{name: "below the app limit", maxMetrics: 10, sets: 5, wantSets: 5},
+		{name: "tag sets overload the app", maxMetrics: 3, sets: 10, wantSets: 4},
+		{name: "metric limit", maxMetrics: 1000, sets: MaxTagSets + 5, wantSets: MaxTagSets},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := CreateAppStatistic("api", CreateLogger(ioutil.Discard))
+			app.SetMaxMetrics(test.maxMetrics)
+			accepted := 0
+			for i := 0; i < test.sets; i++ {
+				if _, err := app.Tagged("requests", map[string]string{"id": strconv.Itoa(i)}); err == nil {
+					accepted++
+				}
+			}
+			if accepted != test.wantSets {
+				t.Errorf("accepted %d tag sets, want %d", accepted, test.wantSets)
+			}
+			if overloaded := app.IsOverloaded(); overloaded != (test.wantSets > test.maxMetrics) {
+				t.Errorf("overloaded %v", overloaded)
+			}
+			// a known tag set is still served and the next flush starts over
+			if _, err := app.Tagged("requests", map[string]string{"id": "0"}); err != nil {
+				t.Errorf("known tag set refused: %v", err)
+			}
+			app.TakeIntMetrics()
+			if _, err := app.Tagged("requests", map[string]string{"id": "new"}); err != nil {
+				t.Errorf("tag set refused after flush: %v", err)
+			}
+		})
+	}
+}
+
+func TestTaggedDropsEmptyChildren(t *testing.T) {
+	tests := []struct {
+		name      string
+		kind      string
+		take      func(app *AppStatistic)
+		wantAfter int
+	}{
+		{name: "int metric", kind: SumTag, take: func(app *AppStatistic) { app.TakeIntMetrics() }, wantAfter: 0},
+		{name: "string metric waits for its flush", kind: StrSumTag, take: func(app *AppStatistic) { app.TakeIntMetrics() }, wantAfter: 3},
+		{name: "string metric", kind: StrSumTag, take: func(app *AppStatistic) { app.TakeStringMetrics() }, wantAfter: 0},
+		{name: "day metric waits for the day", kind: HllDayTag, take: func(app *AppStatistic) { app.TakeIntMetrics() }, wantAfter: 3},
+		{name: "day metric", kind: HllDayTag, take: func(app *AppStatistic) { app.TakeIntDayMetrics() }, wantAfter: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := CreateAppStatistic("api", CreateLogger(ioutil.Discard))
+			for i := 0; i < 3; i++ {
+				tagged, err := app.Tagged("requests", map[string]string{"id": strconv.Itoa(i)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch test.kind {
+				case SumTag:
+					tagged.Sum("requests", 1)
+				case StrSumTag:
+					tagged.StrSum("requests", 1, "eu")
+				case HllDayTag:
+					tagged.HllDay("requests", "user")
+				}
+			}
+			test.take(app)
+			if len(app.tagged) != test.wantAfter {
+				t.Errorf("%d tag sets kept, want %d", len(app.tagged), test.wantAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Events a subscriber may lag behind before new ones are dropped for it
+const TailBuffer = 1000
+
+type TailEvent struct {
+	Time    time.Time         `json:"time"`
+	App     string            `json:"app"`
+	Metric  string            `json:"metric"`
+	Type    string            `json:"type"`
+	Value   float64           `json:"value"`
+	Pattern string            `json:"pattern,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+// TailFilter fields are exact matches when set, App also matches the name without node id
+type TailFilter struct {
+	App    string
+	Metric string
+	Type   string
+}
+
+func (filter TailFilter) matches(record Record) bool {
+	if filter.App != "" && filter.App != record.App && filter.App != strings.SplitN(record.App, "/", 2)[0] {
+		return false
+	}
+	if filter.Metric != "" && filter.Metric != record.Param {
+		return false
+	}
+	return filter.Type == "" || filter.Type == record.Type
+}
+
+type TailSubscriber struct {
+	dropped uint64
+	filter  TailFilter
+	Events  chan TailEvent
+}
+
+// Dropped returns how many events did not fit into the subscriber buffer
+func (subscriber *TailSubscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&subscriber.dropped)
+}
+
+// TailHub hands applied records to subscribers, it never blocks ingestion
+type TailHub struct {
+	mutex       sync.RWMutex
+	subscribers map[*TailSubscriber]bool
+	count       int32
+}
+
+func CreateTailHub() *TailHub {
+	return &TailHub{subscribers: make(map[*TailSubscriber]bool)}
+}
+
+func (hub *TailHub) Subscribe(filter TailFilter) *TailSubscriber {
+	subscriber := &TailSubscriber{filter: filter, Events: make(chan TailEvent, TailBuffer)}
+	hub.mutex.Lock()
+	hub.subscribers[subscriber] = true
+	atomic.StoreInt32(&hub.count, int32(len(hub.subscribers)))
+	hub.mutex.Unlock()
+	return subscriber
+}
+
+func (hub *TailHub) Unsubscribe(subscriber *TailSubscriber) {
+	hub.mutex.Lock()
+	delete(hub.subscribers, subscriber)
+	atomic.StoreInt32(&hub.count, int32(len(hub.subscribers)))
+	hub.mutex.Unlock()
+}
+
+func (hub *TailHub) Publish(record Record) {
+	if atomic.LoadInt32(&hub.count) == 0 {
+		return
+	}
+	var event *TailEvent
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+	for subscriber := range hub.subscribers {
+		if !subscriber.filter.matches(record) {
+			continue
+		}
+		if event == nil {
+			event = &TailEvent{
+				Time:    time.Now().UTC(),
+				App:     record.App,
+				Metric:  record.Param,
+				Type:    record.Type,
+				Value:   record.Value,
+				Pattern: record.Pattern,
+				Tags:    record.Tags,
+			}
+		}
+		select {
+		case subscriber.Events <- *event:
+		default:
+			atomic.AddUint64(&subscriber.dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets of sources not seen for this long are dropped once there are more than sourceBuckets
+const sourceIdle = time.Minute
+const sourceBuckets = 4096
+
+// UdpAcl decides which sources may write and which apps each of them may write. A denied
+// network wins over an allowed one, an empty allow list allows every source
+type UdpAcl struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	apps  []sourceApps
+}
+
+// App name prefixes a source network may write, the most specific network of a source applies
+type sourceApps struct {
+	network  *net.IPNet
+	prefixes []string
+}
+
+// ParseUdpAcl takes comma separated networks like 10.0.0.0/8,192.168.1.7 for allow and deny,
+// and apps as network=prefix|prefix pairs separated by ; like 10.1.0.0/16=api|web
+func ParseUdpAcl(allow, deny, apps string) (*UdpAcl, error) {
+	acl := &UdpAcl{}
+	var err error
+	if acl.allow, err = parseNetworks(allow); err != nil {
+		return nil, err
+	}
+	if acl.deny, err = parseNetworks(deny); err != nil {
+		return nil, err
+	}
+	for _, rule := range strings.Split(apps, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("bad rule %s, expected network=prefix|prefix", rule)
+		}
+		network, err := parseNetwork(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		var prefixes []string
+		for _, prefix := range strings.Split(parts[1], "|") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		acl.apps = append(acl.apps, sourceApps{network: network, prefixes: prefixes})
+	}
+	sort.SliceStable(acl.apps, func(i, j int) bool {
+		a, _ := acl.apps[i].network.Mask.Size()
+		b, _ := acl.apps[j].network.Mask.Size()
+		return a > b
+	})
+	return acl, nil
+}
+
+func parseNetworks(value string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, item := range strings.Split(value, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		network, err := parseNetwork(item)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+// A bare address is a network of one
+func parseNetwork(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("bad address %s", value)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("bad network %s", value)
+	}
+	return network, nil
+}
+
+func containsIp(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed tells whether the source may write at all, a nil acl allows everything
+func (acl *UdpAcl) Allowed(ip net.IP) bool {
+	if acl == nil {
+		return true
+	}
+	if containsIp(acl.deny, ip) {
+		return false
+	}
+	return len(acl.allow) == 0 || containsIp(acl.allow, ip)
+}
+
+// AppAllowed tells whether the source may write app, sources outside every apps network may
+// write any app
+func (acl *UdpAcl) AppAllowed(ip net.IP, app string) bool {
+	if acl == nil {
+		return true
+	}
+	for _, rule := range acl.apps {
+		if !rule.network.Contains(ip) {
+			continue
+		}
+		for _, prefix := range rule.prefixes {
+			if strings.HasPrefix(app, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// sourceLimiter is a token bucket per source address refilled at rate packets a second,
+// a source may send a second worth of packets at once
+type sourceLimiter struct {
+	rate    float64
+	mutex   sync.Mutex
+	buckets map[string]*sourceBucket
+}
+
+type sourceBucket struct {
+	tokens  float64
+	last    time.Time
+	dropped int
+}
+
+func createSourceLimiter(rate int) *sourceLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &sourceLimiter{
+		rate:    float64(rate),
+		buckets: make(map[string]*sourceBucket),
+	}
+}
+
+// Takes a token of source. When one is left after packets were dropped it also returns how
+// many, so the drop is reported once per limited stretch
+func (limiter *sourceLimiter) allow(source string, now time.Time) (bool, int) {
+	if limiter == nil {
+		return true, 0
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	bucket, has := limiter.buckets[source]
+	if !has {
+		if len(limiter.buckets) >= sourceBuckets {
+			limiter.prune(now)
+		}
+		bucket = &sourceBucket{tokens: limiter.rate, last: now}
+		limiter.buckets[source] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * limiter.rate
+	if bucket.tokens > limiter.rate {
+		bucket.tokens = limiter.rate
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		bucket.dropped++
+		return false, 0
+	}
+	bucket.tokens--
+	dropped := bucket.dropped
+	bucket.dropped = 0
+	return true, dropped
+}
+
+func (limiter *sourceLimiter) prune(now time.Time) {
+	for source, bucket := range limiter.buckets {
+		if now.Sub(bucket.last) >= sourceIdle {
+			delete(limiter.buckets, source)
+		}
+	}
+}
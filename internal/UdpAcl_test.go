@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseUdpAcl(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   string
+		deny    string
+		apps    string
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "networks and addresses", allow: "10.0.0.0/8, 192.168.1.7", deny: "10.0.0.1,::1"},
+		{name: "apps", apps: "10.1.0.0/16=api|web; 10.2.0.0/16=billing;"},
+		{name: "bad allow", allow: "10.0.0.0/33", wantErr: true},
+		{name: "bad deny", deny: "host", wantErr: true},
+		{name: "apps without prefixes", apps: "10.1.0.0/16=", wantErr: true},
+		{name: "apps without network", apps: "api|web", wantErr: true},
+		{name: "apps with bad network", apps: "10.1.0/16=api", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseUdpAcl(test.allow, test.deny, test.apps)
+			if (err != nil) != test.wantErr {
+				t.Errorf("error %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestUdpAclAllowed(t *testing.T) {
+	acl, err := ParseUdpAcl("10.0.0.0/8,192.168.1.7", "10.0.0.1", "10.0.0.0/8=api|web;10.1.0.0/16=billing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, err := ParseUdpAcl("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		acl            *UdpAcl
+		ip             string
+		app            string
+		wantAllowed    bool
+		wantAppAllowed bool
+	}{
+		{name: "allowed network", acl: acl, ip: "10.2.3.4", app: "api/1", wantAllowed: true, wantAppAllowed: true},
+		{name: "deny wins", acl: acl, ip: "10.0.0.1", app: "api/1", wantAllowed: false, wantAppAllowed: true},
+		{name: "single address", acl: acl, ip: "192.168.1.7", app: "anything/0", wantAllowed: true, wantAppAllowed: true},
+		{name: "outside allow", acl: acl, ip: "192.168.1.8", app: "api/1", wantAllowed: false, wantAppAllowed: true},
+		{name: "app not in prefixes", acl: acl, ip: "10.2.3.4", app: "billing/1", wantAllowed: true, wantAppAllowed: false},
+		{name: "most specific network", acl: acl, ip: "10.1.3.4", app: "billing/1", wantAllowed: true, wantAppAllowed: true},
+		{name: "most specific network only", acl: acl, ip: "10.1.3.4", app: "api/1", wantAllowed: true, wantAppAllowed: false},
+		{name: "empty acl", acl: open, ip: "8.8.8.8", app: "api/1", wantAllowed: true, wantAppAllowed: true},
+		{name: "nil acl", acl: nil, ip: "8.8.8.8", app: "api/1", wantAllowed: true, wantAppAllowed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ip := net.ParseIP(test.ip)
+			if allowed := test.acl.Allowed(ip); allowed != test.wantAllowed {
+				t.Errorf("Allowed %v, want %v", allowed, test.wantAllowed)
+			}
+			if allowed := test.acl.AppAllowed(ip, test.app); allowed != test.wantAppAllowed {
+				t.Errorf("AppAllowed %v, want %v", allowed, test.wantAppAllowed)
+			}
+		})
+	}
+}
+
+type limiterCall struct {
+	after  time.Duration
+	source string
+}
+
+func TestSourceLimiter(t *testing.T) {
+	tests := []struct {
+		name        string
+		rate        int
+		calls       []limiterCall
+		want        []bool
+		wantDropped []int
+	}{
+		{
+			name:        "no limit",
+			rate:        0,
+			calls:       []limiterCall{{0, "a"}, {0, "a"}, {0, "a"}},
+			want:        []bool{true, true, true},
+			wantDropped: []int{0, 0, 0},
+		},
+		{
+			name:        "burst of a second worth",
+			rate:        2,
+			calls:       []limiterCall{{0, "a"}, {0, "a"}, {0, "a"}, {0, "a"}},
+			want:        []bool{true, true, false, false},
+			wantDropped: []int{0, 0, 0, 0},
+		},
+		{
+			name:        "refill reports the dropped once",
+			rate:        2,
+			calls:       []limiterCall{{0, "a"}, {0, "a"}, {0, "a"}, {0, "a"}, {500 * time.Millisecond, "a"}, {500 * time.Millisecond, "a"}},
+			want:        []bool{true, true, false, false, true, false},
+			wantDropped: []int{0, 0, 0, 0, 2, 0},
+		},
+		{
+			name:        "sources are limited apart",
+			rate:        1,
+			calls:       []limiterCall{{0, "a"}, {0, "b"}, {0, "a"}, {0, "b"}},
+			want:        []bool{true, true, false, false},
+			wantDropped: []int{0, 0, 0, 0},
+		},
+		{
+			name:        "tokens do not pile up past the rate",
+			rate:        1,
+			calls:       []limiterCall{{0, "a"}, {time.Hour, "a"}, {time.Hour, "a"}},
+			want:        []bool{true, true, false},
+			wantDropped: []int{0, 0, 0},
+		},
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := createSourceLimiter(test.rate)
+			for i, call := range test.calls {
+				allowed, dropped := limiter.allow(call.source, start.Add(call.after))
+				if allowed != test.want[i] || dropped != test.wantDropped[i] {
+					t.Errorf("call %d got %v %d, want %v %d", i, allowed, dropped, test.want[i], test.wantDropped[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSourceLimiterPrune(t *testing.T) {
+	limiter := createSourceLimiter(1)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < sourceBuckets; i++ {
+		limiter.allow(net.IPv4(10, 0, byte(i>>8), byte(i)).String(), start)
+	}
+	// a new source past the limit drops the idle ones
+	limiter.allow("192.168.0.1", start.Add(sourceIdle))
+	if len(limiter.buckets) != 1 {
+		t.Errorf("%d buckets after prune, want 1", len(limiter.buckets))
+	}
+}
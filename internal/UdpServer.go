@@ -2,10 +2,12 @@ package internal
 
 import (
 	"bytes"
-	"log"
+	"math"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const SumTag = "P"
@@ -22,49 +24,96 @@ const StrMaxTag = "X"
 const StrAvgTag = "G"
 
 type UpdServer struct {
-	core           *CoreStatistic
-	pc             net.PacketConn
-	host           string
-	stop           bool
-	debounceLogger *log.Logger
+	core    *CoreStatistic
+	pc      net.PacketConn
+	host    string
+	stop    bool
+	logger  *Logger
+	self    *SelfStat
+	acl     *UdpAcl
+	limiter *sourceLimiter
+	mutex   sync.Mutex
 }
 
-func CreateUpdServer(core *CoreStatistic, host string, logger *log.Logger) *UpdServer {
+func CreateUpdServer(core *CoreStatistic, host string, logger *Logger) *UpdServer {
 	return &UpdServer{
-		core:           core,
-		pc:             nil,
-		host:           host,
-		stop:           false,
-		debounceLogger: logger,
+		core:   core,
+		pc:     nil,
+		host:   host,
+		stop:   false,
+		logger: logger.Named("UDP Server"),
 	}
 }
 
+func (server *UpdServer) SetSelfStat(self *SelfStat) {
+	server.self = self
+}
+
+// SetAcl limits the sources that may write and the apps each may write, nil allows all
+func (server *UpdServer) SetAcl(acl *UdpAcl) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.acl = acl
+}
+
+// SetRateLimit sets packets a second each source address may send, 0 turns the limit off.
+// Counting starts over only when the rate changes
+func (server *UpdServer) SetRateLimit(rate int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if (server.limiter == nil && rate <= 0) || (server.limiter != nil && server.limiter.rate == float64(rate)) {
+		return
+	}
+	server.limiter = createSourceLimiter(rate)
+}
+
 func (server *UpdServer) Start() error {
 	pc, err := net.ListenPacket("udp", server.host)
 	if err != nil {
 		return err
 	}
+	server.mutex.Lock()
 	server.pc = pc
-	server.stop = false
-	server.debounceLogger.Println("Start udp on:", server.host)
+	stop := server.stop
+	server.mutex.Unlock()
+	if stop {
+		pc.Close()
+		return nil
+	}
+	server.logger.Info("listening", "address", server.host)
+	buf := make([]byte, 65536)
 	for {
-		buf := make([]byte, 2048)
 		n, addr, err := pc.ReadFrom(buf)
 		if err != nil {
-			if server.stop {
+			if server.stopped() {
 				return nil
 			}
-			server.debounceLogger.Println(err)
+			server.logger.Error("read failed", "error", err)
 		} else {
-			server.serve(pc, addr, buf[:n])
+			server.serve(addr, buf[:n])
 		}
-		if server.stop {
+		if server.stopped() {
 			return nil
 		}
 	}
 }
 
+// ResetStop is called by ServicePoll before every Start
+func (server *UpdServer) ResetStop() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.stop = false
+}
+
+func (server *UpdServer) stopped() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.stop
+}
+
 func (server *UpdServer) Stop() error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
 	server.stop = true
 	if server.pc != nil {
 		return server.pc.Close()
@@ -72,16 +121,79 @@ func (server *UpdServer) Stop() error {
 	return nil
 }
 
+// Access rules apply in place, the address is read on Start so a new one restarts the listener
+func (server *UpdServer) Reload(config *Config) bool {
+	server.SetAcl(config.UdpAccess())
+	server.SetRateLimit(config.UdpRate)
+	if config.Udp == "" || config.Udp == server.host {
+		return false
+	}
+	server.host = config.Udp
+	return true
+}
+
 func (server *UpdServer) GetName() string {
 	return "UDP Server"
 }
 
-func (server *UpdServer) serve(pc net.PacketConn, addr net.Addr, buf []byte) {
-	// RL:AppName:ParamName:TYPE:VALUE
+// A datagram may carry several messages separated by \n
+func (server *UpdServer) serve(addr net.Addr, buf []byte) {
+	server.self.StrSum("packets", 1, "udp")
+	server.mutex.Lock()
+	acl, limiter := server.acl, server.limiter
+	server.mutex.Unlock()
+	ip := sourceIp(addr)
+	if !acl.Allowed(ip) {
+		server.self.StrSum("dropped", 1, "udp denied")
+		server.logger.Warn("packet from denied source dropped", "from", addr.String())
+		return
+	}
+	allowed, dropped := limiter.allow(ip.String(), time.Now())
+	if dropped > 0 {
+		server.logger.Warn("source was rate limited", "from", ip.String(), "dropped", dropped)
+	}
+	if !allowed {
+		server.self.StrSum("dropped", 1, "udp rate_limit")
+		return
+	}
+	for _, line := range bytes.Split(buf, []byte{'\n'}) {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			continue
+		}
+		record, err := ParseRecord(line)
+		if err == nil && !acl.AppAllowed(ip, record.App) {
+			err = recordError("app_denied", "App %s is not allowed from %s", record.App, ip)
+		}
+		if err == nil {
+			err = server.core.Apply(record)
+		}
+		if err != nil {
+			server.self.Rejected("udp", err)
+			server.logger.Warn("record rejected", "reason", errorReason(err), "error", err, "from", addr.String())
+			continue
+		}
+		server.self.StrSum("records", 1, "udp")
+	}
+}
+
+func sourceIp(addr net.Addr) net.IP {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// ParseRecord reads one RL:AppName:ParamName[;tag=value...]:TYPE:VALUE[:pattern] message,
+// VALUE is an int or a float and is kept as is
+func ParseRecord(buf []byte) (Record, error) {
 	if len(buf) < 9 {
 		//Bad pack
-		server.debounceLogger.Printf("Too short message: %s", addr.String())
-		return
+		return Record{}, recordError("short", "Too short message:")
 	}
 	if buf[0] != 'R' || buf[1] != 'L' || buf[2] != ':' {
 		//try skip prefix for syslog perhaps
@@ -90,103 +202,47 @@ func (server *UpdServer) serve(pc net.PacketConn, addr net.Addr, buf []byte) {
 			buf = buf[index:]
 		} else {
 			//Bad pack
-			server.debounceLogger.Printf("Bad message header: %d %d %d %s", buf[0], buf[1], buf[2], string(buf))
-			return
+			return Record{}, recordError("header", "Bad message header: %d %d %d %s", buf[0], buf[1], buf[2], string(buf))
 		}
 	}
 	data := string(buf)
 	dataParts := strings.SplitN(data, ":", 6)
 	if len(dataParts) != 5 && len(dataParts) != 6 {
 		//Bad pack
-		server.debounceLogger.Printf("Bad message format: data=%s len=%d", data, len(dataParts))
-		return
+		return Record{}, recordError("format", "Bad message format: data=%s len=%d", data, len(dataParts))
+	}
+	record := Record{
+		App:  dataParts[1],
+		Type: dataParts[3],
 	}
-	appName := dataParts[1]
-	paramName := dataParts[2]
-	paramType := dataParts[3]
+	param, tags, err := parseTaggedName(dataParts[2])
+	if err != nil {
+		return Record{}, recordError("tags", "%s app:%s", err, record.App)
+	}
+	record.Param = param
+	record.Tags = tags
 	paramValue := dataParts[4]
 
-	value := 0
-	var err error
-
-	if strings.IndexAny(paramValue, ".") != -1 {
-		f, err := strconv.ParseFloat(paramValue, 64)
-		if err != nil {
-			//bad pack
-			server.debounceLogger.Printf("Bad value: metric:%s value:%s app:%s addr:%s", paramName, paramValue, appName, data)
-			return
-		}
-		value = int(f * 1000)
-	} else {
-		value, err = strconv.Atoi(paramValue)
-		if err != nil {
-			//bad pack
-			server.debounceLogger.Printf("Bad value: metric:%s value:%s app:%s addr:%s", paramName, paramValue, appName, data)
-			return
-		}
+	value, err := strconv.ParseFloat(paramValue, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		//bad pack
+		return Record{}, recordError("value", "Bad value: metric:%s value:%s app:%s data:%s", record.Param, paramValue, record.App, data)
 	}
+	record.Value = value
 
-	if paramType == SetTag {
-		server.core.Set(appName, paramName, value)
-	} else if paramType == SumTag {
-		server.core.Sum(appName, paramName, value)
-	} else if paramType == MaxTag {
-		server.core.Max(appName, paramName, value)
-	} else if paramType == MinTag {
-		server.core.Min(appName, paramName, value)
-	} else if paramType == AvgTag {
-		server.core.Avg(appName, paramName, value)
-	} else if paramType == HllDayTag {
+	if isStringTag(record.Type) || record.Type == HllTag || record.Type == HllDayTag {
 		if len(dataParts) != 6 {
-			server.debounceLogger.Printf("Bad message format for string: %s %s", data, addr.String())
-			return
+			return Record{}, recordError("no_pattern", "Bad message format for string: %s", data)
 		}
-		stringValue := dataParts[5]
-		server.core.HllDay(appName, paramName, stringValue)
-	} else if paramType == HllTag {
-		if len(dataParts) != 6 {
-			server.debounceLogger.Printf("Bad message format for string: %s %s", data, addr.String())
-			return
-		}
-		stringValue := dataParts[5]
-		server.core.Hll(appName, paramName, stringValue)
-	} else if paramType == StrSetTag {
-		if len(dataParts) != 6 {
-			server.debounceLogger.Printf("Bad message format for string: %s %s", data, addr.String())
-			return
-		}
-		stringValue := dataParts[5]
-		server.core.StrSet(appName, paramName, value, stringValue)
-	} else if paramType == StrMinTag {
-		if len(dataParts) != 6 {
-			server.debounceLogger.Printf("Bad message format for string: %s %s", data, addr.String())
-			return
-		}
-		stringValue := dataParts[5]
-		server.core.StrMin(appName, paramName, value, stringValue)
-	} else if paramType == StrMaxTag {
-		if len(dataParts) != 6 {
-			server.debounceLogger.Printf("Bad message format for string: %s %s", data, addr.String())
-			return
-		}
-		stringValue := dataParts[5]
-		server.core.StrMax(appName, paramName, value, stringValue)
-	} else if paramType == StrAvgTag {
-		if len(dataParts) != 6 {
-			server.debounceLogger.Printf("Bad message format for string: %s %s", data, addr.String())
-			return
-		}
-		stringValue := dataParts[5]
-		server.core.StrAvg(appName, paramName, value, stringValue)
-	} else if paramType == StrSumTag {
-		if len(dataParts) != 6 {
-			server.debounceLogger.Printf("Bad message format for string: %s %s", data, addr.String())
-			return
-		}
-		stringValue := dataParts[5]
-		server.core.StrSum(appName, paramName, value, stringValue)
-	} else {
-		server.debounceLogger.Printf("Unknown param type: [%s] %s %s", paramType, appName, addr.String())
-		return
+		record.Pattern = dataParts[5]
+	}
+	return record, nil
+}
+
+func isStringTag(paramType string) bool {
+	switch paramType {
+	case StrSumTag, StrSetTag, StrMinTag, StrMaxTag, StrAvgTag:
+		return true
 	}
+	return false
 }
@@ -1,101 +1,301 @@
 package main
 
 import (
-	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/stels-cs/stat-proxy/client"
 	"github.com/stels-cs/stat-proxy/internal"
-	"log"
 	"math/rand"
 	"os"
 	"os/signal"
-	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
-var defaultLogger *log.Logger
+var defaultLogger *internal.Logger
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
-	defaultLogger = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile|log.LUTC)
+	defaultLogger = internal.CreateLogger(os.Stdout)
 }
 
-func GetConfigMap() (map[string]string, error) {
-	configuration := make(map[string]string)
-	filename := "config.json"
-	file, err := os.Open(filename)
+// Bad settings stop the start with every problem listed
+func loadConfig(args []string) *internal.Config {
+	config, err := internal.LoadConfig(args)
 	if err != nil {
-		return configuration, err
+		defaultLogger.Fatal("bad config:\n" + err.Error())
 	}
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&configuration)
+	defaultLogger.Configure(config)
+	return config
+}
+
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad time %s, expected YYYY-MM-DD, YYYY-MM-DDTHH:MM or RFC3339", value)
+}
+
+func rollupService(config *internal.Config) *internal.RollupService {
+	return internal.CreateRollupService(defaultLogger, config.Postgres, time.Duration(config.RollupInterval)*time.Minute,
+		time.Duration(config.RollupDelay)*time.Minute, time.Duration(config.RawRetentionDays)*24*time.Hour, config.RollupDefaultKind)
+}
+
+// stat-proxy rollup <from> <to>
+func runRollup(args []string) {
+	if len(args) != 2 {
+		defaultLogger.Fatal("usage: stat-proxy rollup <from> <to>")
+	}
+	config := loadConfig(nil)
+	if config.Postgres == "" {
+		defaultLogger.Fatal("cant rollup without POSTGRES")
+	}
+	from, err := parseTime(args[0])
 	if err != nil {
-		return configuration, err
+		defaultLogger.Fatal("bad from", "error", err)
 	}
-	return configuration, nil
+	to, err := parseTime(args[1])
+	if err != nil {
+		defaultLogger.Fatal("bad to", "error", err)
+	}
+	err = rollupService(config).RollupRange(from, to)
+	if err != nil {
+		defaultLogger.Fatal("rollup failed", "error", err)
+	}
+	defaultLogger.Info("done")
 }
 
-func env(name string, def string) string {
-	value := os.Getenv(name)
-	if value == "" {
-		config, err := GetConfigMap()
-		if err != nil {
-			return def
-		}
-		value, has := config[name]
-		if has {
-			return value
-		} else {
-			return def
-		}
-		//return ff(v != "", v, def)
-	} else {
-		return value
+// stat-proxy migrate [-dry-run]
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print pending migrations without applying them")
+	_ = flags.Parse(args)
+	config := loadConfig(nil)
+	if config.Postgres == "" {
+		defaultLogger.Fatal("cant migrate without POSTGRES")
+	}
+	conn, err := internal.ConnectPostgres(config.Postgres)
+	if err != nil {
+		defaultLogger.Fatal("cant connect", "error", err)
+	}
+	defer conn.Close()
+	planned, err := internal.CreateMigrator(conn, defaultLogger).MigrateAll(*dryRun)
+	for _, p := range planned {
+		fmt.Printf("-- %s: %d %s\n%s\n", p.Table, p.Migration.Version, p.Migration.Name, p.Migration.SqlFor(p.Table))
+	}
+	if err != nil {
+		defaultLogger.Fatal("migration failed", "error", err)
+	}
+	if len(planned) == 0 {
+		fmt.Println("-- all tables are up to date")
+	}
+}
+
+// stat-proxy config print [flags], prints the effective configuration and what is wrong with it
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		defaultLogger.Fatal("usage: stat-proxy config print [flags]")
+	}
+	config, err := internal.LoadConfig(args[1:])
+	config.Print(os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
 
+// Applies what running services can take, settings that need a restart are only logged
+func reloadConfig(config *internal.Config, core *internal.CoreStatistic, services *internal.ServicePoll) *internal.Config {
+	next, err := internal.LoadConfig(os.Args[1:])
+	if err != nil {
+		defaultLogger.Error("reload failed, settings kept", "error", err)
+		return config
+	}
+	changed := config.Changed(next)
+	if len(changed) == 0 {
+		defaultLogger.Info("reload: nothing changed")
+		return config
+	}
+	defaultLogger.Info("reload", "changed", strings.Join(changed, ","))
+	for _, name := range config.NeedsRestart(next) {
+		defaultLogger.Warn("reload: setting needs a restart to apply", "setting", name)
+	}
+	applied := config.Applied(next)
+	defaultLogger.Configure(applied)
+	core.SetLimits(applied.MaxMetrics, applied.AppLimitMap())
+	services.Reload(applied)
+	return applied
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "rollup" {
+		runRollup(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		runConfig(os.Args[2:])
+		return
+	}
+	config := loadConfig(os.Args[1:])
 
 	services := internal.GetServicePoll(defaultLogger)
-	core := internal.CreateCoreStatistic()
+	services.SetTimeouts(time.Duration(config.StopTimeout)*time.Second, time.Duration(config.ShutdownTimeout)*time.Second)
+	// listeners feeding CoreStatistic, they stop before the final flush
+	var ingest []internal.Service
+	core := internal.CreateCoreStatistic(defaultLogger)
 
-	appName := env("APP", "dev_log_saver/0")
+	core.SetLimits(config.MaxMetrics, config.AppLimitMap())
+	monitor := internal.CreateSelfStat(core, config.SelfAppName())
+	core.SetSelfStat(monitor)
 
-	internal.InitCache(defaultLogger, env("ACCESS_TOKEN", ""))
+	internal.InitCache(defaultLogger, config.AccessToken)
 
-	if env("UDP", "") != "" {
-		udpServer := internal.CreateUpdServer(core, env("UDP", ""), defaultLogger)
+	if config.Udp != "" {
+		udpServer := internal.CreateUpdServer(core, config.Udp, defaultLogger)
+		udpServer.SetSelfStat(monitor)
+		udpServer.SetAcl(config.UdpAccess())
+		udpServer.SetRateLimit(config.UdpRate)
 		services.Push(udpServer)
+		ingest = append(ingest, udpServer)
 	}
 
-	sum := func(name string, value int) {
-		err := internal.LogSum(env("LOG_ADDRESS", "127.0.0.1:1007"), appName, name, value)
+	if config.GraphiteUdp != "" || config.GraphiteTcp != "" {
+		parser, err := internal.CreateGraphiteParser(config.GraphiteRules)
 		if err != nil {
-			defaultLogger.Println("Err sum:", err)
+			defaultLogger.Fatal("bad GRAPHITE_RULES", "error", err)
+		}
+		if config.GraphiteUdp != "" {
+			lineServer := internal.CreateLineServer("Graphite", "udp", config.GraphiteUdp, parser, core, defaultLogger)
+			lineServer.SetSelfStat(monitor)
+			services.Push(lineServer)
+			ingest = append(ingest, lineServer)
+		}
+		if config.GraphiteTcp != "" {
+			lineServer := internal.CreateLineServer("Graphite", "tcp", config.GraphiteTcp, parser, core, defaultLogger)
+			lineServer.SetSelfStat(monitor)
+			services.Push(lineServer)
+			ingest = append(ingest, lineServer)
 		}
 	}
 
-	if env("HTTP", "") != "" {
-		if env("POSTGRES", "") == "" {
-			defaultLogger.Fatal("Cant start http without POSTGRES env")
+	if config.InfluxUdp != "" || config.InfluxTcp != "" {
+		var patternTags []string
+		if config.InfluxPatternTags != "" {
+			patternTags = strings.Split(config.InfluxPatternTags, ",")
 		}
-		saver := internal.CreateStatSaver(defaultLogger, env("POSTGRES", ""), sum)
+		parser, err := internal.CreateInfluxParser(config.InfluxAppTag, config.InfluxNodeTag, patternTags, config.InfluxKind)
+		if err != nil {
+			defaultLogger.Fatal("bad influx settings", "error", err)
+		}
+		if config.InfluxUdp != "" {
+			lineServer := internal.CreateLineServer("Influx", "udp", config.InfluxUdp, parser, core, defaultLogger)
+			lineServer.SetSelfStat(monitor)
+			services.Push(lineServer)
+			ingest = append(ingest, lineServer)
+		}
+		if config.InfluxTcp != "" {
+			lineServer := internal.CreateLineServer("Influx", "tcp", config.InfluxTcp, parser, core, defaultLogger)
+			lineServer.SetSelfStat(monitor)
+			services.Push(lineServer)
+			ingest = append(ingest, lineServer)
+		}
+	}
+
+	if config.OtlpHttp != "" {
+		otlpServer := internal.CreateOtlpServer(config.OtlpHttp, core, defaultLogger)
+		otlpServer.SetSelfStat(monitor)
+		services.Push(otlpServer)
+		ingest = append(ingest, otlpServer)
+	}
+
+	selfStat, err := client.CreateClient(config.LogAddress, config.App)
+	if err != nil {
+		defaultLogger.Warn("self stat client failed", "error", err)
+		selfStat = client.CreateNop()
+	}
+	sum := func(name string, value int) {
+		selfStat.Sum(name, int64(value))
+	}
+
+	notifier := internal.CreateNotifier(config.AlertWebhook, defaultLogger)
+
+	if config.Http != "" {
+		saver := internal.CreateStatSaver(defaultLogger, config.Postgres, sum)
+		saver.SetSelfStat(monitor)
 		services.Push(saver)
-		httpServer := internal.CreateHttpServer(env("HTTP", ""), env("SECRET", "secret"), defaultLogger, saver)
+		services.Push(notifier)
+		if config.ProxyTo == "" {
+			selfSaver := internal.CreateSelfSaver(monitor, saver, time.Duration(config.SaveTime)*time.Second)
+			services.Push(selfSaver)
+			services.DependsOn(selfSaver, saver)
+		}
+		if config.AlertRules != "" {
+			rules, err := internal.LoadAlertRules(config.AlertRules)
+			if err != nil {
+				defaultLogger.Fatal("bad ALERT_RULES", "error", err)
+			}
+			alerts := internal.CreateAlertService(defaultLogger, config.Postgres, rules, notifier,
+				time.Duration(config.AlertInterval)*time.Second)
+			saver.AddListener(alerts)
+			services.Push(alerts)
+			services.DependsOn(alerts, saver)
+		}
+		httpServer := internal.CreateHttpServer(config.Http, config.Secret, defaultLogger, saver)
+		httpServer.SetRemoteWriteLabels(config.PromAppLabel, config.PromNodeLabel)
+		httpServer.SetSelfStat(monitor)
+		httpServer.SetHealth(&services)
+		if config.HeartbeatGrace > 0 {
+			heartbeat := internal.CreateHeartbeatService(defaultLogger, time.Duration(config.HeartbeatGrace)*time.Second, notifier)
+			saver.AddListener(heartbeat)
+			httpServer.SetHeartbeat(heartbeat)
+			services.Push(heartbeat)
+			services.DependsOn(heartbeat, saver)
+		}
+		if config.AnomalyMetrics != "" {
+			targets, err := internal.ParseAnomalyTargets(config.AnomalyMetrics)
+			if err != nil {
+				defaultLogger.Fatal("bad ANOMALY_METRICS", "error", err)
+			}
+			anomaly := internal.CreateAnomalyService(defaultLogger, saver, notifier, targets,
+				time.Duration(config.AnomalyInterval)*time.Minute, config.AnomalyDeviation)
+			services.Push(anomaly)
+			services.DependsOn(anomaly, saver)
+		}
 		services.Push(httpServer)
+		services.DependsOn(httpServer, saver)
 	}
 
-	if env("PROXY_TO", "") != "" {
-		saveTime, err := strconv.Atoi(env("SAVE_TIME", "60"))
-		if err != nil || saveTime <= 1 {
-			defaultLogger.Println("Bad save time, used default: 60", env("SAVE_TIME", "60"))
-			saveTime = 60
-		}
-		proxy := internal.CreateProxySender(core, env("PROXY_TO", ""), env("TMP_FILE", "./data.tmp"), defaultLogger, saveTime)
+	if config.Rollup {
+		services.Push(rollupService(config))
+	}
+
+	if config.ProxyTo != "" {
+		proxy := internal.CreateProxySender(core, config.ProxyTo, config.TmpFile, defaultLogger, config.SaveTime)
+		proxy.SetSelfStat(monitor)
 		services.Push(proxy)
+		services.SetStopTimeout(proxy, time.Duration(config.ShutdownTimeout)*time.Second)
+		for _, listener := range ingest {
+			services.DependsOn(listener, proxy)
+		}
+	}
+
+	if config.AdminHttp != "" {
+		admin := internal.CreateAdminServer(config.AdminHttp, core, defaultLogger)
+		admin.SetSelfStat(monitor)
+		admin.SetHealth(&services)
+		services.Push(admin)
 	}
 
 	if services.Count() == 0 {
-		defaultLogger.Fatal("No service to run")
+		defaultLogger.Fatal("no service to run")
 	}
 
 	if services.Count() > 0 {
@@ -103,10 +303,7 @@ func main() {
 		go func() {
 			t := time.NewTimer(5 * time.Second)
 			<-t.C
-			err := internal.LogSum(env("LOG_ADDRESS", "127.0.0.1:1007"), appName, "start", 1)
-			if err != nil {
-				defaultLogger.Println("Err log:", err)
-			}
+			selfStat.Sum("start", 1)
 
 			//group := internal.Get([]string{"1"})
 			//if g,has:=group["1"]; len(group) != 1 || !has {
@@ -184,11 +381,9 @@ func main() {
 		}()
 
 	} else {
-		err := internal.LogSum(env("LOG_ADDRESS", "127.0.0.1:1007"), appName, "fail_start", 1)
-		if err != nil {
-			defaultLogger.Println("Err log:", err)
-		}
-		defaultLogger.Println("No service to start")
+		selfStat.Sum("fail_start", 1)
+		_ = selfStat.Close()
+		defaultLogger.Error("no service to start")
 		return
 	}
 
@@ -196,9 +391,16 @@ func main() {
 	signal.Notify(signalChan, syscall.SIGINT)
 	signal.Notify(signalChan, syscall.SIGUSR1)
 	signal.Notify(signalChan, syscall.SIGTERM)
+	signal.Notify(signalChan, syscall.SIGHUP)
 	sig := <-signalChan
-	defaultLogger.Println(sig.String())
-	defaultLogger.Println("Stopping...")
-	<-services.StopAll()
-	defaultLogger.Println("Done!")
+	for sig == syscall.SIGHUP {
+		config = reloadConfig(config, core, &services)
+		sig = <-signalChan
+	}
+	defaultLogger.Info("stopping", "signal", sig.String())
+	if !<-services.StopAll() {
+		defaultLogger.Warn("some services did not stop in time")
+	}
+	_ = selfStat.Close()
+	defaultLogger.Info("done")
 }